@@ -0,0 +1,629 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/queone/governa-color"
+)
+
+// manifestName is the archive entry holding the SHA-256 of every regular
+// file in the archive, one "<hex>  <entry name>" line per file. It is
+// written last so the hashes can be computed while streaming.
+const manifestName = ".bak-manifest.sha256"
+
+// archiveEntry describes one file, directory or symlink inside an archive.
+type archiveEntry struct {
+	name       string // slash-separated path inside the archive
+	mode       fs.FileMode
+	modTime    time.Time
+	accessTime time.Time // zero when the archive does not record it
+	uid, gid   int
+	owned      bool // uid and gid are recorded
+	size       int64
+	link       string // symlink target
+}
+
+// atime returns the recorded access time, falling back to the modification
+// time.
+func (e archiveEntry) atime() time.Time {
+	if e.accessTime.IsZero() {
+		return e.modTime
+	}
+	return e.accessTime
+}
+
+// archiveWriter writes entries to a tar.gz or zip archive.
+type archiveWriter interface {
+	writeEntry(e archiveEntry, r io.Reader) error
+	Close() error
+}
+
+type tarGzWriter struct {
+	gz  *gzip.Writer
+	tw  *tar.Writer
+	enc *encWriter // encryption layer under gz; nil for a plain tar.gz
+}
+
+// tarMode returns the tar header mode for m: its permission bits plus
+// setuid, setgid and sticky, the same bits copies keep.
+func tarMode(m fs.FileMode) int64 {
+	mode := int64(m.Perm())
+	if m&fs.ModeSetuid != 0 {
+		mode |= 0o4000
+	}
+	if m&fs.ModeSetgid != 0 {
+		mode |= 0o2000
+	}
+	if m&fs.ModeSticky != 0 {
+		mode |= 0o1000
+	}
+	return mode
+}
+
+func (w *tarGzWriter) writeEntry(e archiveEntry, r io.Reader) error {
+	hdr := &tar.Header{
+		Name:       e.name,
+		Mode:       tarMode(e.mode),
+		ModTime:    e.modTime,
+		AccessTime: e.accessTime,
+		Uid:        e.uid,
+		Gid:        e.gid,
+		Format:     tar.FormatPAX, // keeps the access time and sub-second times
+	}
+	switch {
+	case e.mode.IsDir():
+		hdr.Typeflag = tar.TypeDir
+		hdr.Name += "/"
+	case e.mode&fs.ModeSymlink != 0:
+		hdr.Typeflag = tar.TypeSymlink
+		hdr.Linkname = e.link
+	default:
+		hdr.Typeflag = tar.TypeReg
+		hdr.Size = e.size
+	}
+	if err := w.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if hdr.Typeflag == tar.TypeReg {
+		_, err := io.Copy(w.tw, r)
+		return err
+	}
+	return nil
+}
+
+func (w *tarGzWriter) Close() error {
+	if err := errors.Join(w.tw.Close(), w.gz.Close()); err != nil || w.enc == nil {
+		return err
+	}
+	return w.enc.Close()
+}
+
+type zipWriter struct {
+	zw *zip.Writer
+}
+
+func (w *zipWriter) writeEntry(e archiveEntry, r io.Reader) error {
+	hdr := &zip.FileHeader{Name: e.name, Method: zip.Deflate, Modified: e.modTime}
+	hdr.SetMode(e.mode)
+	if e.mode.IsDir() {
+		hdr.Name += "/"
+		hdr.Method = zip.Store
+	}
+	out, err := w.zw.CreateHeader(hdr)
+	if err != nil {
+		return err
+	}
+	switch {
+	case e.mode.IsDir():
+		return nil
+	case e.mode&fs.ModeSymlink != 0:
+		_, err = io.WriteString(out, e.link)
+	default:
+		_, err = io.Copy(out, r)
+	}
+	return err
+}
+
+func (w *zipWriter) Close() error {
+	return w.zw.Close()
+}
+
+// newArchiveWriter returns a writer for the archive format named by ext.
+func newArchiveWriter(out io.Writer, ext string) (archiveWriter, error) {
+	switch ext {
+	case ".tar.gz":
+		gz := gzip.NewWriter(out)
+		return &tarGzWriter{gz: gz, tw: tar.NewWriter(gz)}, nil
+	case encExt:
+		pass, err := readPassphrase(true)
+		if err != nil {
+			return nil, err
+		}
+		enc, err := newEncWriter(out, pass)
+		if err != nil {
+			return nil, err
+		}
+		gz := gzip.NewWriter(enc)
+		return &tarGzWriter{gz: gz, tw: tar.NewWriter(gz), enc: enc}, nil
+	case ".zip":
+		return &zipWriter{zw: zip.NewWriter(out)}, nil
+	}
+	return nil, fmt.Errorf("unsupported archive format %q; use tar.gz or zip", strings.TrimPrefix(ext, "."))
+}
+
+// writeArchive stores src (a file or directory) under its base name in a new
+// archive at dst, adds x's excludeRecord and appends the SHA-256 manifest.
+// Entries matched by x and entries other than regular files, directories
+// and symlinks are left out, the latter with a warning.
+func writeArchive(src, dst, ext string, x *excluder, warn io.Writer) (err error) {
+	f, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(dst)
+		}
+	}()
+
+	buf := bufio.NewWriter(f)
+	aw, err := newArchiveWriter(buf, ext)
+	if err != nil {
+		return err
+	}
+
+	var manifest strings.Builder
+	root := filepath.Base(src)
+	walkErr := filepath.WalkDir(src, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		if x.skip(p, rel, d) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		e := archiveEntry{
+			name:       path.Join(root, filepath.ToSlash(rel)),
+			mode:       info.Mode(),
+			modTime:    info.ModTime(),
+			accessTime: fileAtime(info),
+			size:       info.Size(),
+		}
+		e.uid, e.gid, e.owned = fileOwner(info)
+
+		switch {
+		case info.IsDir():
+			return aw.writeEntry(e, nil)
+		case info.Mode()&fs.ModeSymlink != 0:
+			if e.link, err = os.Readlink(p); err != nil {
+				return err
+			}
+			return aw.writeEntry(e, nil)
+		case info.Mode().IsRegular():
+			in, err := os.Open(p)
+			if err != nil {
+				return err
+			}
+			defer in.Close()
+			h := sha256.New()
+			if err := aw.writeEntry(e, io.TeeReader(in, h)); err != nil {
+				return err
+			}
+			fmt.Fprintf(&manifest, "%s  %s\n", hex.EncodeToString(h.Sum(nil)), e.name)
+			return nil
+		}
+		fmt.Fprintf(warn, "%s: skipping special file %s\n", programName, p)
+		return nil
+	})
+	if walkErr != nil {
+		return walkErr
+	}
+	if rec := x.record(); rec != "" {
+		re := archiveEntry{name: path.Join(root, excludeRecord), mode: 0644, modTime: time.Now(), size: int64(len(rec))}
+		if err := aw.writeEntry(re, strings.NewReader(rec)); err != nil {
+			return err
+		}
+		sum := sha256.Sum256([]byte(rec))
+		fmt.Fprintf(&manifest, "%s  %s\n", hex.EncodeToString(sum[:]), re.name)
+	}
+
+	m := manifest.String()
+	me := archiveEntry{name: manifestName, mode: 0644, modTime: time.Now(), size: int64(len(m))}
+	if err := aw.writeEntry(me, strings.NewReader(m)); err != nil {
+		return err
+	}
+	if err := aw.Close(); err != nil {
+		return err
+	}
+	return buf.Flush()
+}
+
+// archiveExt returns the archive extension of name, or "" when name is not
+// an archive bak knows how to read.
+func archiveExt(name string) string {
+	for _, ext := range archiveExts {
+		if strings.HasSuffix(name, ext) {
+			return ext
+		}
+	}
+	return ""
+}
+
+// walkArchive calls fn for every entry of the tar.gz, encrypted tar.gz or
+// zip archive at p, in archive order. Encrypted archives need the
+// passphrase. The reader is only meaningful for regular files.
+func walkArchive(p string, fn func(e archiveEntry, r io.Reader) error) error {
+	switch archiveExt(p) {
+	case ".tar.gz":
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return walkTarGz(bufio.NewReader(f), fn)
+	case encExt:
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		pass, err := readPassphrase(false)
+		if err != nil {
+			return err
+		}
+		dec, err := newEncReader(bufio.NewReader(f), pass)
+		if err != nil {
+			return err
+		}
+		return walkTarGz(dec, fn)
+	case ".zip":
+		zr, err := zip.OpenReader(p)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		for _, zf := range zr.File {
+			e := archiveEntry{
+				name:    strings.TrimSuffix(zf.Name, "/"),
+				mode:    zf.Mode(),
+				modTime: zf.Modified,
+				size:    int64(zf.UncompressedSize64),
+			}
+			if err := walkZipEntry(zf, e, fn); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("%s is not a .tar.gz, .tar.gz.enc or .zip archive", p)
+}
+
+// walkTarGz calls fn for every entry of the tar.gz stream r. The stream is
+// read to its end so gzip and encryption trailers are checked too.
+func walkTarGz(r io.Reader, fn func(e archiveEntry, r io.Reader) error) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			_, err = io.Copy(io.Discard, gz)
+			return err
+		}
+		if err != nil {
+			return err
+		}
+		info := hdr.FileInfo()
+		e := archiveEntry{
+			name:       strings.TrimSuffix(hdr.Name, "/"),
+			mode:       info.Mode(),
+			modTime:    hdr.ModTime,
+			accessTime: hdr.AccessTime,
+			uid:        hdr.Uid,
+			gid:        hdr.Gid,
+			owned:      true,
+			size:       hdr.Size,
+			link:       hdr.Linkname,
+		}
+		if err := fn(e, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// walkZipEntry opens one zip member, resolving symlink targets, and hands it
+// to fn.
+func walkZipEntry(zf *zip.File, e archiveEntry, fn func(e archiveEntry, r io.Reader) error) error {
+	if e.mode.IsDir() {
+		return fn(e, nil)
+	}
+	rc, err := zf.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	if e.mode&fs.ModeSymlink != 0 {
+		target, err := io.ReadAll(rc)
+		if err != nil {
+			return err
+		}
+		e.link = string(target)
+		return fn(e, nil)
+	}
+	return fn(e, rc)
+}
+
+// archiveStats returns the on-disk size of an archive and the number of
+// files and symlinks it holds, not counting the manifest or the
+// excludeRecord.
+func archiveStats(p string) (int64, int, error) {
+	info, err := os.Stat(p)
+	if err != nil {
+		return 0, 0, err
+	}
+	count := 0
+	err = walkArchive(p, func(e archiveEntry, r io.Reader) error {
+		_, rest, _ := strings.Cut(e.name, "/")
+		if !e.mode.IsDir() && e.name != manifestName && rest != excludeRecord {
+			count++
+		}
+		return nil
+	})
+	return info.Size(), count, err
+}
+
+// safeJoin joins an archive entry name onto dir, rejecting names that would
+// escape it.
+func safeJoin(dir, name string) (string, error) {
+	clean := path.Clean(name)
+	if clean == "." || path.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("unsafe archive entry %q", name)
+	}
+	return filepath.Join(dir, filepath.FromSlash(clean)), nil
+}
+
+// checkNoLinks rejects the archive entry name, joined onto dir as target,
+// when target or any directory between dir and target is a symlink. A
+// link extracted earlier would otherwise let later entries be written
+// wherever it points.
+func checkNoLinks(dir, target, name string) error {
+	rel, err := filepath.Rel(dir, target)
+	if err != nil {
+		return err
+	}
+	p, walked := dir, ""
+	for part := range strings.SplitSeq(rel, string(filepath.Separator)) {
+		p, walked = filepath.Join(p, part), path.Join(walked, part)
+		info, err := os.Lstat(p)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode()&fs.ModeSymlink != 0 {
+			return fmt.Errorf("unsafe archive entry %q: %s is a symlink", name, walked)
+		}
+	}
+	return nil
+}
+
+// extractArchive unpacks an archive into dir, skipping the manifest.
+func extractArchive(p, dir string) error {
+	var dirs []archiveEntry
+	err := walkArchive(p, func(e archiveEntry, r io.Reader) error {
+		if e.name == manifestName {
+			return nil
+		}
+		target, err := safeJoin(dir, e.name)
+		if err != nil {
+			return err
+		}
+		if err := checkNoLinks(dir, target, e.name); err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		switch {
+		case e.mode.IsDir():
+			dirs = append(dirs, e)
+			return os.MkdirAll(target, 0700)
+		case e.mode&fs.ModeSymlink != 0:
+			if err := os.Symlink(e.link, target); err != nil {
+				return err
+			}
+			if err := e.chown(target); err != nil {
+				return err
+			}
+			return setLinkTimes(target, e.atime(), e.modTime)
+		}
+		out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_EXCL, e.mode.Perm())
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(out, r); err != nil {
+			out.Close()
+			return err
+		}
+		if err := out.Close(); err != nil {
+			return err
+		}
+		return e.apply(target)
+	})
+	if err != nil {
+		return err
+	}
+	// Directory modes are applied last so read-only directories can still be
+	// populated.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		target, _ := safeJoin(dir, dirs[i].name)
+		if err := dirs[i].apply(target); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// chown gives the extracted entry at target its recorded owner. Like
+// applyMeta it is best effort: only root can hand files to other users.
+func (e archiveEntry) chown(target string) error {
+	if !e.owned {
+		return nil
+	}
+	if err := os.Lchown(target, e.uid, e.gid); err != nil && !errors.Is(err, fs.ErrPermission) {
+		return err
+	}
+	return nil
+}
+
+// apply gives the extracted file or directory at target the owner, mode
+// bits and times recorded in e. The owner comes first, as chown clears
+// setuid and setgid.
+func (e archiveEntry) apply(target string) error {
+	if err := e.chown(target); err != nil {
+		return err
+	}
+	if err := os.Chmod(target, e.mode&preservedMode); err != nil {
+		return err
+	}
+	return os.Chtimes(target, e.atime(), e.modTime)
+}
+
+// verifyResult lists the manifest discrepancies found in an archive.
+type verifyResult struct {
+	files    int      // regular files hashed
+	mismatch []string // content does not match the manifest
+	missing  []string // listed in the manifest but absent
+	extra    []string // present but not listed in the manifest
+}
+
+func (v verifyResult) ok() bool {
+	return len(v.mismatch) == 0 && len(v.missing) == 0 && len(v.extra) == 0
+}
+
+// parseManifest reads "<hex>  <name>" lines into a name-to-hash map.
+func parseManifest(data string) (map[string]string, error) {
+	sums := map[string]string{}
+	for i, line := range strings.Split(strings.TrimRight(data, "\n"), "\n") {
+		if line == "" {
+			continue
+		}
+		sum, name, ok := strings.Cut(line, "  ")
+		if !ok || len(sum) != sha256.Size*2 {
+			return nil, fmt.Errorf("manifest line %d is malformed", i+1)
+		}
+		sums[name] = sum
+	}
+	return sums, nil
+}
+
+// checkArchive re-hashes every regular file in the archive at p and
+// compares the results with its manifest.
+func checkArchive(p string) (verifyResult, error) {
+	var res verifyResult
+	hashes := map[string]string{}
+	var manifest string
+	found := false
+	err := walkArchive(p, func(e archiveEntry, r io.Reader) error {
+		if !e.mode.IsRegular() {
+			return nil
+		}
+		if e.name == manifestName {
+			data, err := io.ReadAll(r)
+			manifest, found = string(data), true
+			return err
+		}
+		h := sha256.New()
+		if _, err := io.Copy(h, r); err != nil {
+			return err
+		}
+		hashes[e.name] = hex.EncodeToString(h.Sum(nil))
+		return nil
+	})
+	if err != nil {
+		return res, fmt.Errorf("reading %s: %w (the archive may be truncated or corrupt)", p, err)
+	}
+	if !found {
+		return res, fmt.Errorf("%s has no %s manifest; only archives written by %s --archive can be verified", p, manifestName, programName)
+	}
+	sums, err := parseManifest(manifest)
+	if err != nil {
+		return res, fmt.Errorf("%s: %w", p, err)
+	}
+
+	res.files = len(hashes)
+	for name, sum := range sums {
+		got, ok := hashes[name]
+		switch {
+		case !ok:
+			res.missing = append(res.missing, name)
+		case got != sum:
+			res.mismatch = append(res.mismatch, name)
+		}
+	}
+	for name := range hashes {
+		if _, ok := sums[name]; !ok {
+			res.extra = append(res.extra, name)
+		}
+	}
+	sort.Strings(res.mismatch)
+	sort.Strings(res.missing)
+	sort.Strings(res.extra)
+	return res, nil
+}
+
+// verifyArchive prints the result of checkArchive and fails when the
+// archive does not match its manifest.
+func verifyArchive(p string, w io.Writer) error {
+	res, err := checkArchive(p)
+	if err != nil {
+		return err
+	}
+	for _, name := range res.mismatch {
+		fmt.Fprintf(w, "  %s  %s\n", color.Red5("FAILED "), name)
+	}
+	for _, name := range res.missing {
+		fmt.Fprintf(w, "  %s  %s\n", color.Red5("MISSING"), name)
+	}
+	for _, name := range res.extra {
+		fmt.Fprintf(w, "  %s  %s\n", color.Yel5("EXTRA  "), name)
+	}
+	if !res.ok() {
+		return fmt.Errorf("%s failed verification: %d mismatched, %d missing, %d unlisted",
+			p, len(res.mismatch), len(res.missing), len(res.extra))
+	}
+	fmt.Fprintf(w, "%s: %d file(s) %s\n", p, res.files, color.Grn5("OK"))
+	return nil
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestArchiveRoundTrip(t *testing.T) {
+	for _, ext := range archiveExts {
+		t.Run(ext, func(t *testing.T) {
+			testPassphrase(t)
+			dir := t.TempDir()
+			writeFiles(t, dir, map[string]string{"app/a": "alpha", "app/sub/b": "beta"})
+			src := filepath.Join(dir, "app")
+
+			opts := options{archive: ext}
+			target, err := createBackup(src, time.Date(2025, 1, 1, 0, 0, 0, 0, time.Local), opts, io.Discard, io.Discard)
+			if err != nil {
+				t.Fatalf("createBackup: %v", err)
+			}
+			if filepath.Base(target) != "app.20250101"+ext {
+				t.Fatalf("archive name = %s", filepath.Base(target))
+			}
+
+			res, err := checkArchive(target)
+			if err != nil || !res.ok() || res.files != 2 {
+				t.Fatalf("checkArchive = %+v, %v", res, err)
+			}
+
+			size, count, err := archiveStats(target)
+			if err != nil || size == 0 || count != 2 {
+				t.Fatalf("archiveStats = %d, %d, %v", size, count, err)
+			}
+
+			out := t.TempDir()
+			if err := extractArchive(target, out); err != nil {
+				t.Fatalf("extractArchive: %v", err)
+			}
+			data, err := os.ReadFile(filepath.Join(out, "app", "sub", "b"))
+			if err != nil || string(data) != "beta" {
+				t.Fatalf("extracted sub/b = %q, %v", data, err)
+			}
+		})
+	}
+}
+
+func TestArchiveSharesStampWithCopies(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"app/a": "1", "app.20250101.tar.gz": "x"})
+	target, err := createBackup(filepath.Join(dir, "app"), time.Date(2025, 1, 1, 0, 0, 0, 0, time.Local), options{}, io.Discard, io.Discard)
+	if err != nil {
+		t.Fatalf("createBackup: %v", err)
+	}
+	if filepath.Base(target) != "app.20250101a" {
+		t.Fatalf("copy name = %s, want app.20250101a", filepath.Base(target))
+	}
+}
+
+func TestVerifyArchiveDetectsTampering(t *testing.T) {
+	target := filepath.Join(t.TempDir(), "app.20250101.tar.gz")
+	f, err := os.Create(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aw, err := newArchiveWriter(f, ".tar.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := []struct {
+		name, content string
+	}{
+		{"app/a", "alpha"},
+		{"app/extra", "x"},
+		{manifestName, strings.Repeat("0", 64) + "  app/a\n" + strings.Repeat("1", 64) + "  app/gone\n"},
+	}
+	for _, e := range entries {
+		ae := archiveEntry{name: e.name, mode: 0644, modTime: time.Now(), size: int64(len(e.content))}
+		if err := aw.writeEntry(ae, strings.NewReader(e.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := aw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	res, err := checkArchive(target)
+	if err != nil {
+		t.Fatalf("checkArchive: %v", err)
+	}
+	if strings.Join(res.mismatch, ",") != "app/a" || strings.Join(res.missing, ",") != "app/gone" || strings.Join(res.extra, ",") != "app/extra" {
+		t.Fatalf("checkArchive = %+v", res)
+	}
+	var out bytes.Buffer
+	if err := verifyArchive(target, &out); err == nil {
+		t.Fatalf("verifyArchive succeeded on tampered archive: %q", out.String())
+	}
+}
+
+func TestParseManifestRejectsGarbage(t *testing.T) {
+	if _, err := parseManifest("not a manifest line\n"); err == nil {
+		t.Fatal("parseManifest accepted a malformed line")
+	}
+}
+
+func TestSafeJoin(t *testing.T) {
+	for _, name := range []string{"../evil", "/abs", "a/../../evil", "."} {
+		if _, err := safeJoin("/tmp/x", name); err == nil {
+			t.Errorf("safeJoin(%q) succeeded, want error", name)
+		}
+	}
+	got, err := safeJoin("/tmp/x", "app/a")
+	if err != nil || got != filepath.Join("/tmp/x", "app", "a") {
+		t.Fatalf("safeJoin(app/a) = %q, %v", got, err)
+	}
+}
+
+func TestRestoreFromArchive(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"app/conf": "good"})
+	src := filepath.Join(dir, "app")
+	if _, err := createBackup(src, time.Now(), options{archive: ".tar.gz"}, io.Discard, io.Discard); err != nil {
+		t.Fatalf("createBackup: %v", err)
+	}
+	writeFiles(t, dir, map[string]string{"app/conf": "broken"})
+
+	var out bytes.Buffer
+	if err := restoreBackup(src, "", true, &out); err != nil {
+		t.Fatalf("restoreBackup: %v", err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(src, "conf")); string(data) != "good" {
+		t.Fatalf("restored conf = %q", data)
+	}
+	entries, _ := os.ReadDir(dir)
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), ".bak-extract-") {
+			t.Fatalf("temporary extract dir left behind: %s", e.Name())
+		}
+	}
+}
+
+func TestExtractRejectsEntriesThroughSymlinks(t *testing.T) {
+	dir := t.TempDir()
+	outside := t.TempDir()
+	writeFiles(t, dir, map[string]string{"proj/a": "alpha"})
+	target := filepath.Join(dir, "proj.20250101.tar.gz")
+	f, err := os.Create(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aw, err := newArchiveWriter(f, ".tar.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	if err := aw.writeEntry(archiveEntry{name: "proj/esc", mode: os.ModeSymlink | 0777, modTime: now, link: outside}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := aw.writeEntry(archiveEntry{name: "proj/esc/pwned", mode: 0644, modTime: now, size: 1}, strings.NewReader("x")); err != nil {
+		t.Fatal(err)
+	}
+	if err := aw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	var out bytes.Buffer
+	if err := restoreBackup(filepath.Join(dir, "proj"), "", false, &out); err == nil {
+		t.Fatalf("restoreBackup accepted an entry written through a symlink: %q", out.String())
+	}
+	if _, err := os.Lstat(filepath.Join(outside, "pwned")); err == nil {
+		t.Fatal("extraction wrote outside its directory")
+	}
+}
+
+func TestArchiveKeepsSpecialModeBits(t *testing.T) {
+	for _, ext := range []string{".tar.gz", ".zip"} {
+		t.Run(ext, func(t *testing.T) {
+			dir := t.TempDir()
+			writeFiles(t, dir, map[string]string{"app/tmp/x": "x", "app/run": "#!/bin/sh\n"})
+			src := filepath.Join(dir, "app")
+			if err := os.Chmod(filepath.Join(src, "tmp"), 0777|os.ModeSticky); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chmod(filepath.Join(src, "run"), 0755|os.ModeSetuid|os.ModeSetgid); err != nil {
+				t.Fatal(err)
+			}
+			target, err := createBackup(src, time.Now(), options{archive: ext}, io.Discard, io.Discard)
+			if err != nil {
+				t.Fatalf("createBackup: %v", err)
+			}
+			out := t.TempDir()
+			if err := extractArchive(target, out); err != nil {
+				t.Fatalf("extractArchive: %v", err)
+			}
+			if info, err := os.Stat(filepath.Join(out, "app", "tmp")); err != nil || info.Mode()&preservedMode != 0777|os.ModeSticky {
+				t.Fatalf("tmp mode = %v, %v; want sticky 0777", info.Mode(), err)
+			}
+			if info, err := os.Stat(filepath.Join(out, "app", "run")); err != nil || info.Mode()&preservedMode != 0755|os.ModeSetuid|os.ModeSetgid {
+				t.Fatalf("run mode = %v, %v; want setuid, setgid 0755", info.Mode(), err)
+			}
+		})
+	}
+}
+
+func TestArchiveRestoreKeepsOwnerAndTimes(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("changing file owners needs root")
+	}
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"app/conf": "good", "app/sub/f": "f"})
+	src := filepath.Join(dir, "app")
+	atime := time.Date(2021, 2, 3, 4, 5, 6, 0, time.UTC)
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, rel := range []string{"conf", "sub/f", "sub"} {
+		p := filepath.Join(src, rel)
+		if err := os.Lchown(p, 1234, 1234); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(p, atime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("conf", filepath.Join(src, "link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Lchown(filepath.Join(src, "link"), 1234, 1234); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := createBackup(src, time.Now(), options{archive: ".tar.gz"}, io.Discard, io.Discard); err != nil {
+		t.Fatalf("createBackup: %v", err)
+	}
+	if err := os.RemoveAll(src); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := restoreBackup(src, "", true, io.Discard); err != nil {
+		t.Fatalf("restoreBackup: %v", err)
+	}
+	for _, rel := range []string{"conf", "sub/f", "sub", "link"} {
+		info, err := os.Lstat(filepath.Join(src, rel))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if uid, gid, _ := fileOwner(info); uid != 1234 || gid != 1234 {
+			t.Errorf("%s owner = %d:%d, want 1234:1234", rel, uid, gid)
+		}
+		if rel != "link" && !info.ModTime().Equal(mtime) {
+			t.Errorf("%s mtime = %v, want %v", rel, info.ModTime(), mtime)
+		}
+		// Restoring reads directories, which moves their access times on.
+		if info.Mode().IsRegular() && !fileAtime(info).Equal(atime) {
+			t.Errorf("%s atime = %v, want %v", rel, fileAtime(info), atime)
+		}
+	}
+}
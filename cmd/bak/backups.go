@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/queone/governa-color"
+	"github.com/queone/utils/internal/bytesize"
+)
+
+// backupStamp matches the part of a backup name that follows "<src>.": an
+// eight-digit date, the optional alphabetic suffix from nextSuffix, and the
+// archive extension when the backup is an archive.
+var backupStamp = regexp.MustCompile(`^([0-9]{8})([a-z]*)(\.tar\.gz|\.tar\.gz\.enc|\.zip)?$`)
+
+// archiveExts lists the archive extensions a backup may carry, in the form
+// used by --archive; encExt is written by --encrypt.
+var archiveExts = []string{".tar.gz", ".zip", encExt}
+
+// backup is one existing dated copy of a source path.
+type backup struct {
+	path   string    // path of the backup itself
+	base   string    // base name of the source it was made from
+	date   time.Time // day parsed from the YYYYMMDD stamp
+	suffix string    // nextSuffix value; empty for the first backup of a day
+	ext    string    // archive extension; empty for a plain copy
+}
+
+// name returns the backup's file or directory name.
+func (b backup) name() string {
+	return filepath.Base(b.path)
+}
+
+// parseBackupName reports whether name is a backup of a source whose base
+// name is base. The returned backup's path is name itself.
+func parseBackupName(base, name string) (backup, bool) {
+	rest, ok := strings.CutPrefix(name, base+".")
+	if !ok {
+		return backup{}, false
+	}
+	m := backupStamp.FindStringSubmatch(rest)
+	if m == nil {
+		return backup{}, false
+	}
+	date, err := time.ParseInLocation("20060102", m[1], time.Local)
+	if err != nil {
+		return backup{}, false
+	}
+	return backup{path: name, base: base, date: date, suffix: m[2], ext: m[3]}, true
+}
+
+// suffixLess orders suffixes the way nextSuffix issues them: shorter
+// suffixes first, then alphabetically.
+func suffixLess(a, b string) bool {
+	if len(a) != len(b) {
+		return len(a) < len(b)
+	}
+	return a < b
+}
+
+// findBackups returns every sibling of src that follows the backup naming
+// scheme, oldest first.
+func findBackups(src string) ([]backup, error) {
+	dir := filepath.Dir(src)
+	base := filepath.Base(src)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w (check the path and try again)", dir, err)
+	}
+
+	var found []backup
+	for _, e := range entries {
+		b, ok := parseBackupName(base, e.Name())
+		if !ok {
+			continue
+		}
+		b.path = filepath.Join(dir, e.Name())
+		found = append(found, b)
+	}
+	sort.Slice(found, func(i, j int) bool {
+		if !found[i].date.Equal(found[j].date) {
+			return found[i].date.Before(found[j].date)
+		}
+		return suffixLess(found[i].suffix, found[j].suffix)
+	})
+	return found, nil
+}
+
+// latestCopy returns the newest backup of src that is a plain directory
+// copy, or "" when there is none.
+func latestCopy(src string) (string, error) {
+	backups, err := findBackups(src)
+	if err != nil {
+		return "", err
+	}
+	for i := len(backups) - 1; i >= 0; i-- {
+		if backups[i].ext != "" {
+			continue
+		}
+		if info, err := os.Lstat(backups[i].path); err == nil && info.IsDir() {
+			return backups[i].path, nil
+		}
+	}
+	return "", nil
+}
+
+// treeStats returns the total size in bytes and the number of non-directory
+// entries under path, which may be a file or a directory, not counting the
+// excludeRecord at its root.
+func treeStats(path string) (int64, int, error) {
+	var size int64
+	count := 0
+	err := filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || p == filepath.Join(path, excludeRecord) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		count++
+		return nil
+	})
+	return size, count, err
+}
+
+// listBackups prints every backup of src with its date, size and file count.
+func listBackups(src string, w io.Writer) error {
+	backups, err := findBackups(src)
+	if err != nil {
+		return err
+	}
+	if len(backups) == 0 {
+		fmt.Fprintf(w, "No backups of %s found.\n", src)
+		return nil
+	}
+
+	for _, b := range backups {
+		var size int64
+		var count int
+		if b.ext == encExt {
+			// Counting files would need the passphrase.
+			info, err := os.Stat(b.path)
+			if err != nil {
+				return fmt.Errorf("reading backup %s: %w", b.path, err)
+			}
+			fmt.Fprintf(w, "%s  %8s  %14s  %s\n",
+				b.date.Format("2006-01-02"), bytesize.Format(info.Size()), "encrypted", color.Grn5(b.name()))
+			continue
+		}
+		if b.ext != "" {
+			size, count, err = archiveStats(b.path)
+		} else {
+			size, count, err = treeStats(b.path)
+		}
+		if err != nil {
+			return fmt.Errorf("reading backup %s: %w", b.path, err)
+		}
+		fmt.Fprintf(w, "%s  %8s  %6d file(s)  %s\n",
+			b.date.Format("2006-01-02"), bytesize.Format(size), count, color.Grn5(b.name()))
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseBackupName(t *testing.T) {
+	cases := []struct {
+		name   string
+		ok     bool
+		suffix string
+		ext    string
+	}{
+		{"app.20250101", true, "", ""},
+		{"app.20250101a", true, "a", ""},
+		{"app.20250101zz", true, "zz", ""},
+		{"app.20250101.tar.gz", true, "", ".tar.gz"},
+		{"app.20250101b.zip", true, "b", ".zip"},
+		{"app.2025010", false, "", ""},
+		{"app.20251301", false, "", ""},
+		{"app.20250101A", false, "", ""},
+		{"app.20250101.bak", false, "", ""},
+		{"app.20250101.tar", false, "", ""},
+		{"apple.20250101", false, "", ""},
+		{"app", false, "", ""},
+	}
+	for _, tc := range cases {
+		b, ok := parseBackupName("app", tc.name)
+		if ok != tc.ok || b.suffix != tc.suffix || b.ext != tc.ext {
+			t.Errorf("parseBackupName(%q) = (%q, %q, %v), want (%q, %q, %v)",
+				tc.name, b.suffix, b.ext, ok, tc.suffix, tc.ext, tc.ok)
+		}
+	}
+}
+
+func TestFindBackupsOrder(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"app/x":            "1",
+		"app.20250102/x":   "1",
+		"app.20250101b/x":  "1",
+		"app.20250101/x":   "1",
+		"app.20250101az/x": "1",
+		"app.20250101a/x":  "1",
+		"app.notes/x":      "1",
+	})
+
+	backups, err := findBackups(filepath.Join(dir, "app"))
+	if err != nil {
+		t.Fatalf("findBackups: %v", err)
+	}
+	var names []string
+	for _, b := range backups {
+		names = append(names, b.name())
+	}
+	want := "app.20250101,app.20250101a,app.20250101b,app.20250101az,app.20250102"
+	if got := strings.Join(names, ","); got != want {
+		t.Fatalf("findBackups order = %s, want %s", got, want)
+	}
+}
+
+func TestListBackups(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"app/a":            "12345",
+		"app.20250101/a":   "12",
+		"app.20250101/b/c": "345",
+	})
+
+	var out bytes.Buffer
+	if err := listBackups(filepath.Join(dir, "app"), &out); err != nil {
+		t.Fatalf("listBackups: %v", err)
+	}
+	got := out.String()
+	for _, want := range []string{"2025-01-01", "5B", "2 file(s)", "app.20250101"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("listBackups output missing %q: %q", want, got)
+		}
+	}
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"sync"
+	"sync/atomic"
+)
+
+// copier makes metadata-faithful copies of files and directory trees:
+// symlinks stay symlinks, and permission bits, ownership and timestamps are
+// carried over. Sockets, FIFOs and devices are skipped with a warning.
+//
+// When linkDest names a previous copy of the same tree, regular files that
+// are unchanged since that copy are hard-linked from it instead of copied.
+type copier struct {
+	deref    bool      // copy what symlinks point to instead of the links
+	warn     io.Writer // receives skipped-file warnings
+	linkDest string    // previous copy to hard-link unchanged files from
+	checksum bool      // also compare contents before hard-linking
+	exclude  *excluder // .bakignore and --exclude rules; nil copies everything
+	jobs     int       // files copied at once; 0 picks defaultJobs
+	progress *progress // counts copied files; nil copies quietly
+	record   string    // written to the root of a directory copy as excludeRecord
+
+	dstRoot string       // destination passed to copyPath
+	dirs    []dirMeta    // directories created so far, parents first
+	work    chan copyJob // feeds the copyDir workers
+	linked  atomic.Int64 // files hard-linked from linkDest
+	copied  atomic.Int64 // files copied
+
+	mu  sync.Mutex // guards warn and err
+	err error      // first failure of any worker
+}
+
+// dirMeta remembers a created directory and the source info to apply to it.
+type dirMeta struct {
+	path string
+	info fs.FileInfo
+}
+
+// copyJob is one non-directory entry for a copyDir worker.
+type copyJob struct {
+	src, dst string
+	info     fs.FileInfo
+	chain    []string
+}
+
+// preservedMode keeps the permission bits plus setuid, setgid and sticky.
+const preservedMode = fs.ModePerm | fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky
+
+// defaultJobs is the number of concurrent file copies when none is given.
+// Beyond a handful, parallel copies mostly contend for the same disk.
+func defaultJobs() int {
+	return min(runtime.NumCPU(), 8)
+}
+
+// copyPath copies src, a file or directory, to dst, which must not exist.
+func (c *copier) copyPath(src, dst string) error {
+	c.dstRoot = dst
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return c.copyDir(src, dst)
+	}
+	return c.copyEntry(src, dst, info, nil)
+}
+
+// copyDir copies the tree at src to dst. The walk runs in the calling
+// goroutine, creating directories and handing everything else to a bounded
+// pool of workers. Directory modes and times are applied once all workers
+// are done, deepest first, so read-only directories can still be filled and
+// parents keep their original mtimes.
+func (c *copier) copyDir(src, dst string) error {
+	n := c.jobs
+	if n < 1 {
+		n = defaultJobs()
+	}
+	c.work = make(chan copyJob, n)
+	var wg sync.WaitGroup
+	for range n {
+		wg.Go(func() {
+			for j := range c.work {
+				if c.failed() == nil {
+					c.fail(c.copyEntry(j.src, j.dst, j.info, j.chain))
+				}
+			}
+		})
+	}
+	c.fail(c.copyTree(src, dst, []string{src}))
+	close(c.work)
+	wg.Wait()
+	c.work = nil
+	if err := c.failed(); err != nil {
+		return err
+	}
+	if c.record != "" {
+		if err := writeRecord(filepath.Join(dst, excludeRecord), c.record); err != nil {
+			return err
+		}
+	}
+
+	for i := len(c.dirs) - 1; i >= 0; i-- {
+		if err := applyMeta(c.dirs[i].path, c.dirs[i].info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyTree walks src, mirroring it under dst. chain lists the directories
+// being copied, used to stop dereferenced symlink loops.
+func (c *copier) copyTree(src, dst string, chain []string) error {
+	return filepath.WalkDir(src, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := c.failed(); err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if c.exclude != nil {
+			if rootRel, err := filepath.Rel(c.dstRoot, target); err == nil && c.exclude.skip(p, rootRel, d) {
+				if d.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		switch {
+		case d.IsDir():
+			c.dirs = append(c.dirs, dirMeta{target, info})
+			return os.Mkdir(target, 0700)
+		case c.deref && info.Mode()&fs.ModeSymlink != 0:
+			// Followed directories are walked here rather than in a
+			// worker, so their files join the same pool.
+			return c.copyDeref(p, target, chain)
+		}
+		c.work <- copyJob{p, target, info, chain}
+		return nil
+	})
+}
+
+// fail records the first non-nil error reported by the walk or a worker.
+func (c *copier) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err == nil {
+		c.err = err
+	}
+}
+
+// failed returns the first recorded error, if any.
+func (c *copier) failed() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// warnf writes one warning line; workers may call it concurrently.
+func (c *copier) warnf(format string, args ...any) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(c.warn, "%s: "+format+"\n", append([]any{programName}, args...)...)
+}
+
+// copyEntry copies one non-directory entry whose Lstat info is given.
+func (c *copier) copyEntry(src, dst string, info fs.FileInfo, chain []string) error {
+	mode := info.Mode()
+	switch {
+	case mode&fs.ModeSymlink != 0:
+		if c.deref {
+			return c.copyDeref(src, dst, chain)
+		}
+		c.progress.add(0)
+		return copySymlink(src, dst, info)
+	case mode.IsRegular():
+		defer c.progress.add(info.Size())
+		if c.linkDest != "" {
+			linked, err := c.linkUnchanged(src, dst, info)
+			if linked || err != nil {
+				return err
+			}
+		}
+		c.copied.Add(1)
+		return copyFile(src, dst, info)
+	}
+	c.warnf("skipping special file %s (%s)", src, mode.Type())
+	return nil
+}
+
+// copyDeref copies whatever the symlink at src points to. Broken links and
+// links back into a directory already being copied are kept as links.
+func (c *copier) copyDeref(src, dst string, chain []string) error {
+	linfo, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(src)
+	if err != nil {
+		c.warnf("keeping broken symlink %s", src)
+		c.progress.add(0)
+		return copySymlink(src, dst, linfo)
+	}
+	if !info.IsDir() {
+		return c.copyEntry(src, dst, info, chain)
+	}
+
+	real, err := filepath.EvalSymlinks(src)
+	if err != nil {
+		return err
+	}
+	for _, p := range chain {
+		if r, err := filepath.EvalSymlinks(p); err == nil && r == real {
+			c.warnf("keeping looping symlink %s", src)
+			c.progress.add(0)
+			return copySymlink(src, dst, linfo)
+		}
+	}
+	return c.copyTree(real, dst, append(slices.Clone(chain), real))
+}
+
+// linkUnchanged hard-links dst to the file at the same relative path in
+// linkDest when that file matches src in size, modification time and mode
+// (and content, with checksum set). It reports whether it linked.
+func (c *copier) linkUnchanged(src, dst string, info fs.FileInfo) (bool, error) {
+	rel, err := filepath.Rel(c.dstRoot, dst)
+	if err != nil {
+		return false, err
+	}
+	prev := filepath.Join(c.linkDest, rel)
+	pinfo, err := os.Lstat(prev)
+	if err != nil || !pinfo.Mode().IsRegular() {
+		return false, nil
+	}
+	if pinfo.Size() != info.Size() || !pinfo.ModTime().Equal(info.ModTime()) || pinfo.Mode() != info.Mode() {
+		return false, nil
+	}
+	if c.checksum {
+		same, err := sameContent(src, prev)
+		if err != nil || !same {
+			return false, err
+		}
+	}
+	if err := os.Link(prev, dst); err != nil {
+		// Filesystems without hard links fall back to a plain copy.
+		return false, nil
+	}
+	c.linked.Add(1)
+	return true, nil
+}
+
+// copyFile copies a regular file's content and metadata to dst, which must
+// not exist.
+func copyFile(src, dst string, info fs.FileInfo) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return applyMeta(dst, info)
+}
+
+// copySymlink recreates the symlink at src, with the same target, owner
+// and times, at dst.
+func copySymlink(src, dst string, info fs.FileInfo) error {
+	target, err := os.Readlink(src)
+	if err != nil {
+		return err
+	}
+	if err := os.Symlink(target, dst); err != nil {
+		return err
+	}
+	if uid, gid, ok := fileOwner(info); ok {
+		if err := os.Lchown(dst, uid, gid); err != nil && !errors.Is(err, fs.ErrPermission) {
+			return err
+		}
+	}
+	return setLinkTimes(dst, fileAtime(info), info.ModTime())
+}
+
+// applyMeta gives path the ownership, mode bits and access and modification
+// times recorded in info. Ownership is best effort: only root can hand files
+// to other users.
+func applyMeta(path string, info fs.FileInfo) error {
+	if uid, gid, ok := fileOwner(info); ok {
+		if err := os.Lchown(path, uid, gid); err != nil && !errors.Is(err, fs.ErrPermission) {
+			return err
+		}
+	}
+	if err := os.Chmod(path, info.Mode()&preservedMode); err != nil {
+		return err
+	}
+	return os.Chtimes(path, fileAtime(info), info.ModTime())
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCopierPreservesMetadata(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "app")
+	writeFiles(t, dir, map[string]string{"app/open/f": "data", "app/locked/g": "g"})
+	stamp := time.Date(2020, 5, 6, 7, 8, 9, 0, time.UTC)
+
+	if err := os.Chmod(filepath.Join(src, "open"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(filepath.Join(src, "open", "f"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(filepath.Join(src, "open", "f"), stamp, stamp); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("open/f", filepath.Join(src, "link")); err != nil {
+		t.Skipf("symlinks unavailable: %v", err)
+	}
+	if err := setLinkTimes(filepath.Join(src, "link"), stamp, stamp); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(filepath.Join(src, "locked"), 0500); err != nil {
+		t.Fatal(err)
+	}
+	dst := filepath.Join(dir, "copy")
+	t.Cleanup(func() {
+		os.Chmod(filepath.Join(src, "locked"), 0700)
+		os.Chmod(filepath.Join(dst, "locked"), 0700)
+	})
+
+	if err := (&copier{warn: &bytes.Buffer{}}).copyPath(src, dst); err != nil {
+		t.Fatalf("copyPath: %v", err)
+	}
+
+	if info, err := os.Stat(filepath.Join(dst, "open")); err != nil || info.Mode().Perm() != 0777 {
+		t.Fatalf("open dir mode = %v, %v; want 0777", info.Mode(), err)
+	}
+	if info, err := os.Stat(filepath.Join(dst, "locked")); err != nil || info.Mode().Perm() != 0500 {
+		t.Fatalf("locked dir mode = %v, %v; want 0500", info.Mode(), err)
+	}
+	info, err := os.Stat(filepath.Join(dst, "open", "f"))
+	if err != nil || info.Mode().Perm() != 0640 || !info.ModTime().Equal(stamp) {
+		t.Fatalf("file meta = %v %v, %v; want 0640 %v", info.Mode(), info.ModTime(), err, stamp)
+	}
+	if target, err := os.Readlink(filepath.Join(dst, "link")); err != nil || target != "open/f" {
+		t.Fatalf("link = %q, %v; want symlink to open/f", target, err)
+	}
+	// Platforms without lutimes leave the source link's time alone too.
+	if sinfo, err := os.Lstat(filepath.Join(src, "link")); err == nil && sinfo.ModTime().Equal(stamp) {
+		if info, err := os.Lstat(filepath.Join(dst, "link")); err != nil || !info.ModTime().Equal(stamp) {
+			t.Fatalf("link mtime = %v, %v; want %v", info.ModTime(), err, stamp)
+		}
+	}
+}
+
+func TestCopierDereference(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"app/real/f": "data", "outside/o": "o"})
+	src := filepath.Join(dir, "app")
+	for link, target := range map[string]string{
+		"file":   "real/f",
+		"ext":    "../outside",
+		"loop":   ".",
+		"broken": "nowhere",
+	} {
+		if err := os.Symlink(target, filepath.Join(src, link)); err != nil {
+			t.Skipf("symlinks unavailable: %v", err)
+		}
+	}
+
+	var warn bytes.Buffer
+	dst := filepath.Join(dir, "copy")
+	if err := (&copier{deref: true, warn: &warn}).copyPath(src, dst); err != nil {
+		t.Fatalf("copyPath: %v", err)
+	}
+	for _, rel := range []string{"file", "ext/o"} {
+		info, err := os.Lstat(filepath.Join(dst, rel))
+		if err != nil || !info.Mode().IsRegular() {
+			t.Errorf("%s: want regular file, got %v, %v", rel, info, err)
+		}
+	}
+	for _, rel := range []string{"loop", "broken"} {
+		info, err := os.Lstat(filepath.Join(dst, rel))
+		if err != nil || info.Mode()&os.ModeSymlink == 0 {
+			t.Errorf("%s: want symlink kept, got %v, %v", rel, info, err)
+		}
+	}
+	if !strings.Contains(warn.String(), "looping symlink") || !strings.Contains(warn.String(), "broken symlink") {
+		t.Errorf("warnings = %q", warn.String())
+	}
+}
+
+func TestCopierSkipsSpecialFiles(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"app/f": "data"})
+	sock := filepath.Join(dir, "app", "s.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Skipf("unix sockets unavailable: %v", err)
+	}
+	defer l.Close()
+
+	var warn bytes.Buffer
+	dst := filepath.Join(dir, "copy")
+	c := &copier{warn: &warn, progress: newProgress(nil)}
+	if err := c.copyPath(filepath.Join(dir, "app"), dst); err != nil {
+		t.Fatalf("copyPath: %v", err)
+	}
+	files, _, _ := scanTree(filepath.Join(dir, "app"), nil, nil)
+	if got := c.progress.files.Load(); got != 1 || files != 1 {
+		t.Errorf("copied %d file(s), scanned %d; want 1 each", got, files)
+	}
+	if _, err := os.Lstat(filepath.Join(dst, "s.sock")); !os.IsNotExist(err) {
+		t.Fatalf("socket copied: %v", err)
+	}
+	if !strings.Contains(warn.String(), "skipping special file") {
+		t.Fatalf("warnings = %q", warn.String())
+	}
+}
+
+func TestCopierParallelJobs(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{}
+	for i := range 50 {
+		files[fmt.Sprintf("app/d%d/f%d", i%7, i)] = strings.Repeat("x", i)
+	}
+	writeFiles(t, dir, files)
+	src := filepath.Join(dir, "app")
+
+	for _, jobs := range []int{1, 4} {
+		dst := filepath.Join(dir, fmt.Sprintf("copy%d", jobs))
+		c := &copier{warn: &bytes.Buffer{}, jobs: jobs, progress: newProgress(nil)}
+		if err := c.copyPath(src, dst); err != nil {
+			t.Fatalf("jobs=%d: copyPath: %v", jobs, err)
+		}
+		if got := c.progress.files.Load(); got != 50 {
+			t.Fatalf("jobs=%d: progress counted %d files, want 50", jobs, got)
+		}
+		for rel, want := range files {
+			data, err := os.ReadFile(filepath.Join(dst, strings.TrimPrefix(rel, "app/")))
+			if err != nil || string(data) != want {
+				t.Fatalf("jobs=%d: %s = %q, %v", jobs, rel, data, err)
+			}
+		}
+	}
+}
+
+func TestProgressLine(t *testing.T) {
+	p := newProgress(nil)
+	p.add(1024)
+	p.add(1024)
+	if got := p.line(p.start.Add(2 * time.Second)); got != "2 files  2.0K  1.0K/s  counting..." {
+		t.Fatalf("line before totals = %q", got)
+	}
+	p.setTotals(10, 4096)
+	got := p.line(p.start.Add(2 * time.Second))
+	want := "2/10 files  2.0K/4.0K  1.0K/s  ETA 2s"
+	if got != want {
+		t.Fatalf("line = %q, want %q", got, want)
+	}
+	if s := p.summary("app.20250101", p.start.Add(1500*time.Millisecond)); s != "app.20250101: 2 file(s), 2.0K in 1.5s" {
+		t.Fatalf("summary = %q", s)
+	}
+}
+
+func TestScanTreeHonorsExcluder(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"a": "12", "logs/x.log": "123", "b.log": "1"})
+	x, err := loadExcluder(dir, []string{"*.log"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files, bytes, ok := scanTree(dir, x, nil); !ok || files != 1 || bytes != 2 {
+		t.Fatalf("scanTree = %d, %d, %v; want 1, 2, true", files, bytes, ok)
+	}
+}
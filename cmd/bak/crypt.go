@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/term"
+)
+
+// Encrypted backups are tar.gz archives sealed in a chunked AES-256-GCM
+// stream. The file starts with a header holding a magic string, the scrypt
+// cost parameters, a random salt and a random nonce prefix. It is followed
+// by chunks of up to encChunkSize plaintext bytes, each written as a flag
+// byte, a big-endian ciphertext length and the ciphertext. Chunk nonces are
+// the prefix plus a chunk counter, and every chunk authenticates the header
+// and its flag, so reordered, truncated or extended files fail to decrypt.
+const (
+	encExt       = ".tar.gz.enc"
+	encMagic     = "BAKENC1\n"
+	encSaltSize  = 16
+	encPrefixLen = 8
+	encHeaderLen = len(encMagic) + 3 + encSaltSize + encPrefixLen
+	encChunkSize = 64 * 1024
+
+	chunkMore  byte = 0
+	chunkFinal byte = 1
+)
+
+// passphraseEnv names the environment variable that supplies the
+// passphrase for unattended runs; without it bak prompts on the terminal.
+const passphraseEnv = "BAK_PASSPHRASE"
+
+// scryptLogN is the log2 scrypt work factor used for new backups. Readers
+// take the factor from the file header, up to scryptMaxLogN.
+var scryptLogN byte = 17
+
+const (
+	scryptR       = 8
+	scryptP       = 1
+	scryptMaxLogN = 22
+)
+
+var errDecrypt = errors.New("cannot decrypt: wrong passphrase or damaged file")
+
+// encryptedName matches an encrypted backup name and captures the name of
+// the source it was made from.
+var encryptedName = regexp.MustCompile(`^(.+)\.[0-9]{8}[a-z]*\.tar\.gz\.enc$`)
+
+// readPassphrase returns the passphrase from BAK_PASSPHRASE or, failing
+// that, prompts for it on the terminal. With confirm set it asks twice.
+func readPassphrase(confirm bool) ([]byte, error) {
+	if p := os.Getenv(passphraseEnv); p != "" {
+		return []byte(p), nil
+	}
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return nil, fmt.Errorf("no terminal to prompt for a passphrase (set %s)", passphraseEnv)
+	}
+	prompt := func(label string) ([]byte, error) {
+		fmt.Fprint(os.Stderr, label)
+		p, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		return p, err
+	}
+	p, err := prompt("Passphrase: ")
+	if err != nil {
+		return nil, err
+	}
+	if len(p) == 0 {
+		return nil, errors.New("empty passphrase")
+	}
+	if confirm {
+		again, err := prompt("Confirm passphrase: ")
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(p, again) {
+			return nil, errors.New("passphrases do not match")
+		}
+	}
+	return p, nil
+}
+
+// newGCM derives a 256-bit key from pass with scrypt and returns an
+// AES-GCM cipher using it.
+func newGCM(pass, salt []byte, logN, r, p byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key(pass, salt, 1<<logN, int(r), int(p), 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encStream holds what the writer and reader share: the cipher, the header
+// every chunk authenticates and the running chunk counter.
+type encStream struct {
+	aead    cipher.AEAD
+	header  []byte
+	counter uint32
+}
+
+func (s *encStream) nonce() []byte {
+	n := make([]byte, s.aead.NonceSize())
+	copy(n, s.header[encHeaderLen-encPrefixLen:])
+	binary.BigEndian.PutUint32(n[len(n)-4:], s.counter)
+	return n
+}
+
+func (s *encStream) aad(flag byte) []byte {
+	return append(bytes.Clone(s.header), flag)
+}
+
+// encWriter encrypts everything written to it onto out. Close must be
+// called to write the final chunk; it does not close out.
+type encWriter struct {
+	encStream
+	out io.Writer
+	buf []byte
+}
+
+// newEncWriter writes a fresh header, with a new salt and nonce prefix, to
+// out and returns a writer encrypting under pass.
+func newEncWriter(out io.Writer, pass []byte) (*encWriter, error) {
+	header := make([]byte, encHeaderLen)
+	n := copy(header, encMagic)
+	header[n], header[n+1], header[n+2] = scryptLogN, scryptR, scryptP
+	if _, err := rand.Read(header[n+3:]); err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(pass, header[n+3:n+3+encSaltSize], scryptLogN, scryptR, scryptP)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := out.Write(header); err != nil {
+		return nil, err
+	}
+	return &encWriter{
+		encStream: encStream{aead: aead, header: header},
+		out:       out,
+		buf:       make([]byte, 0, encChunkSize),
+	}, nil
+}
+
+func (w *encWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		// A full chunk is only sealed once more data arrives, so the last
+		// one can be marked final in Close.
+		if len(w.buf) == encChunkSize {
+			if err := w.seal(chunkMore); err != nil {
+				return n, err
+			}
+		}
+		k := min(encChunkSize-len(w.buf), len(p))
+		w.buf = append(w.buf, p[:k]...)
+		p = p[k:]
+		n += k
+	}
+	return n, nil
+}
+
+func (w *encWriter) seal(flag byte) error {
+	if w.counter == math.MaxUint32 {
+		return errors.New("encrypted stream too large")
+	}
+	ct := w.aead.Seal(nil, w.nonce(), w.buf, w.aad(flag))
+	var hdr [5]byte
+	hdr[0] = flag
+	binary.BigEndian.PutUint32(hdr[1:], uint32(len(ct)))
+	if _, err := w.out.Write(hdr[:]); err != nil {
+		return err
+	}
+	if _, err := w.out.Write(ct); err != nil {
+		return err
+	}
+	w.counter++
+	w.buf = w.buf[:0]
+	return nil
+}
+
+// Close seals the buffered data as the final chunk.
+func (w *encWriter) Close() error {
+	return w.seal(chunkFinal)
+}
+
+// encReader decrypts a stream written by encWriter.
+type encReader struct {
+	encStream
+	in   io.Reader
+	buf  []byte
+	done bool
+}
+
+// newEncReader reads and checks the header from in and returns a reader
+// decrypting under pass.
+func newEncReader(in io.Reader, pass []byte) (*encReader, error) {
+	header := make([]byte, encHeaderLen)
+	if _, err := io.ReadFull(in, header); err != nil || string(header[:len(encMagic)]) != encMagic {
+		return nil, errors.New("not an encrypted bak archive")
+	}
+	n := len(encMagic)
+	logN, r, p := header[n], header[n+1], header[n+2]
+	if logN == 0 || logN > scryptMaxLogN || r == 0 || p == 0 {
+		return nil, fmt.Errorf("unsupported key derivation parameters (N=2^%d, r=%d, p=%d)", logN, r, p)
+	}
+	aead, err := newGCM(pass, header[n+3:n+3+encSaltSize], logN, r, p)
+	if err != nil {
+		return nil, err
+	}
+	return &encReader{encStream: encStream{aead: aead, header: header}, in: in}, nil
+}
+
+func (d *encReader) Read(p []byte) (int, error) {
+	for len(d.buf) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		if err := d.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.buf)
+	d.buf = d.buf[n:]
+	return n, nil
+}
+
+// next decrypts the following chunk into buf.
+func (d *encReader) next() error {
+	var hdr [5]byte
+	if _, err := io.ReadFull(d.in, hdr[:]); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return errors.New("encrypted stream is truncated")
+		}
+		return err
+	}
+	flag, size := hdr[0], binary.BigEndian.Uint32(hdr[1:])
+	if flag != chunkMore && flag != chunkFinal || size > encChunkSize+uint32(d.aead.Overhead()) {
+		return errDecrypt
+	}
+	ct := make([]byte, size)
+	if _, err := io.ReadFull(d.in, ct); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return errors.New("encrypted stream is truncated")
+		}
+		return err
+	}
+	pt, err := d.aead.Open(ct[:0], d.nonce(), ct, d.aad(flag))
+	if err != nil {
+		return errDecrypt
+	}
+	d.counter++
+	d.buf = pt
+	if flag == chunkFinal {
+		d.done = true
+		if n, _ := d.in.Read(make([]byte, 1)); n > 0 {
+			return errors.New("unexpected data after the end of the encrypted stream")
+		}
+	}
+	return nil
+}
+
+// decryptBackup shows how restoring the encrypted backup at p into dst would
+// change it and, when force is set, restores it. An empty dst is the source
+// the backup was made from, derived from the backup's name.
+func decryptBackup(p, dst string, force bool, w io.Writer) error {
+	m := encryptedName.FindStringSubmatch(filepath.Base(p))
+	if m == nil {
+		return fmt.Errorf("%s is not an encrypted backup (expected <src>.YYYYMMDD[suffix]%s)", p, encExt)
+	}
+	b, _ := parseBackupName(m[1], filepath.Base(p))
+	b.path = p
+	if dst == "" {
+		dst = filepath.Join(filepath.Dir(p), m[1])
+	}
+	return restoreFrom(dst, b, force, w)
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testPassphrase supplies a passphrase through the environment and lowers
+// the scrypt cost so tests stay fast.
+func testPassphrase(t *testing.T) {
+	t.Helper()
+	t.Setenv(passphraseEnv, "correct horse")
+	old := scryptLogN
+	scryptLogN = 10
+	t.Cleanup(func() { scryptLogN = old })
+}
+
+func encrypt(t *testing.T, pass string, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w, err := newEncWriter(&buf, []byte(pass))
+	if err != nil {
+		t.Fatalf("newEncWriter: %v", err)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func decrypt(pass string, data []byte) ([]byte, error) {
+	r, err := newEncReader(bytes.NewReader(data), []byte(pass))
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+func TestEncryptedStreamRoundTrip(t *testing.T) {
+	testPassphrase(t)
+	for _, size := range []int{0, 1, encChunkSize, 3*encChunkSize + 17} {
+		data := bytes.Repeat([]byte("0123456789abcdef"), size/16+1)[:size]
+		got, err := decrypt("pw", encrypt(t, "pw", data))
+		if err != nil || !bytes.Equal(got, data) {
+			t.Fatalf("size %d: round trip = %d bytes, %v", size, len(got), err)
+		}
+	}
+}
+
+func TestEncryptedStreamRejectsTampering(t *testing.T) {
+	testPassphrase(t)
+	data := bytes.Repeat([]byte("x"), 2*encChunkSize+100)
+	sealed := encrypt(t, "pw", data)
+	chunk := 5 + encChunkSize + 16
+
+	if _, err := decrypt("wrong", sealed); !errors.Is(err, errDecrypt) {
+		t.Errorf("wrong passphrase: err = %v, want errDecrypt", err)
+	}
+
+	flipped := bytes.Clone(sealed)
+	flipped[len(flipped)-1] ^= 1
+	if _, err := decrypt("pw", flipped); !errors.Is(err, errDecrypt) {
+		t.Errorf("flipped byte: err = %v, want errDecrypt", err)
+	}
+
+	// Dropping the final chunk leaves a stream that ends cleanly on a chunk
+	// boundary, which must still be caught.
+	truncated := sealed[:encHeaderLen+2*chunk]
+	if _, err := decrypt("pw", truncated); err == nil || !strings.Contains(err.Error(), "truncated") {
+		t.Errorf("truncated stream: err = %v, want truncation error", err)
+	}
+
+	extended := append(bytes.Clone(sealed), 0)
+	if _, err := decrypt("pw", extended); err == nil {
+		t.Error("trailing data: decrypt succeeded, want error")
+	}
+}
+
+func TestEncryptedBackupRestore(t *testing.T) {
+	testPassphrase(t)
+	dir := t.TempDir()
+	src := filepath.Join(dir, "sms")
+	writeFiles(t, dir, map[string]string{"sms/config.ini": "token=secret"})
+
+	opts, err := parseArgs([]string{"--encrypt", src})
+	if err != nil {
+		t.Fatalf("parseArgs: %v", err)
+	}
+	target, err := createBackup(src, time.Date(2025, 1, 1, 0, 0, 0, 0, time.Local), opts, io.Discard, io.Discard)
+	if err != nil {
+		t.Fatalf("createBackup: %v", err)
+	}
+	if filepath.Base(target) != "sms.20250101.tar.gz.enc" {
+		t.Fatalf("backup name = %s", filepath.Base(target))
+	}
+	raw, err := os.ReadFile(target)
+	if err != nil || bytes.Contains(raw, []byte("secret")) {
+		t.Fatalf("backup holds plaintext or is unreadable: %v", err)
+	}
+
+	var out bytes.Buffer
+	if err := listBackups(src, &out); err != nil || !strings.Contains(out.String(), "encrypted") {
+		t.Fatalf("listBackups = %q, %v", out.String(), err)
+	}
+	if err := verifyArchive(target, io.Discard); err != nil {
+		t.Fatalf("verifyArchive: %v", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(src, "config.ini"), []byte("token=lost"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	out.Reset()
+	if err := run([]string{"--decrypt", target}, &out, io.Discard); err != nil {
+		t.Fatalf("decrypt dry run: %v", err)
+	}
+	if !strings.Contains(out.String(), "config.ini") || !strings.Contains(out.String(), "DRY RUN") {
+		t.Fatalf("decrypt dry run output = %q", out.String())
+	}
+	if err := run([]string{"--decrypt", target, "-f"}, io.Discard, io.Discard); err != nil {
+		t.Fatalf("decrypt: %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(src, "config.ini"))
+	if err != nil || string(data) != "token=secret" {
+		t.Fatalf("restored config.ini = %q, %v", data, err)
+	}
+
+	t.Setenv(passphraseEnv, "guess")
+	if err := decryptBackup(target, "", true, io.Discard); err == nil {
+		t.Fatal("decrypt with wrong passphrase succeeded")
+	}
+}
+
+func TestDecryptRejectsOtherNames(t *testing.T) {
+	if err := decryptBackup(filepath.Join(t.TempDir(), "app.20250101.tar.gz"), "", false, io.Discard); err == nil {
+		t.Fatal("decryptBackup accepted a plain archive name")
+	}
+	if _, err := parseArgs([]string{"--encrypt", "--archive=zip", "x"}); err == nil {
+		t.Fatal("parseArgs accepted --encrypt with --archive=zip")
+	}
+	if _, err := parseArgs([]string{"--archive=tar.gz.enc", "x"}); err == nil {
+		t.Fatal("parseArgs accepted --archive=tar.gz.enc")
+	}
+}
+
+func TestDecryptToDestination(t *testing.T) {
+	testPassphrase(t)
+	share := t.TempDir()
+	writeFiles(t, share, map[string]string{"sms/config.ini": "token=secret"})
+	target, err := createBackup(filepath.Join(share, "sms"), time.Now(), options{archive: encExt}, io.Discard, io.Discard)
+	if err != nil {
+		t.Fatalf("createBackup: %v", err)
+	}
+	if err := os.RemoveAll(filepath.Join(share, "sms")); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("TMPDIR", t.TempDir())
+
+	b, _ := parseBackupName("sms", filepath.Base(target))
+	b.path = target
+	root, cleanup, err := backupRoot(b)
+	if err != nil {
+		t.Fatalf("backupRoot: %v", err)
+	}
+	tmp := filepath.Dir(root)
+	if filepath.Dir(tmp) != os.TempDir() {
+		t.Errorf("extracted into %s, want a directory under %s", tmp, os.TempDir())
+	}
+	if info, err := os.Stat(tmp); err != nil || info.Mode().Perm() != 0700 {
+		t.Errorf("extract dir mode = %v, %v; want 0700", info.Mode(), err)
+	}
+	cleanup()
+
+	dst := filepath.Join(t.TempDir(), "restored")
+	if err := run([]string{"--decrypt", target, dst, "-f"}, io.Discard, io.Discard); err != nil {
+		t.Fatalf("decrypt: %v", err)
+	}
+	if data, err := os.ReadFile(filepath.Join(dst, "config.ini")); err != nil || string(data) != "token=secret" {
+		t.Fatalf("restored config.ini = %q, %v", data, err)
+	}
+	if entries, _ := os.ReadDir(share); len(entries) != 1 {
+		t.Fatalf("share holds %d entries, want only the encrypted backup", len(entries))
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/queone/utils/internal/bytesize"
+	"github.com/queone/utils/internal/ignore"
+)
+
+// ignoreFile is read from the root of a directory being backed up. It uses
+// gitignore syntax.
+const ignoreFile = ".bakignore"
+
+// excludeRecord is written to the root of a directory backup made with
+// --exclude. It lists those patterns in gitignore syntax, so a restore
+// leaves the same paths alone.
+const excludeRecord = ".bak-exclude"
+
+// excluder applies .bakignore and --exclude rules while walking a source
+// tree and tallies what they leave out. A nil excluder excludes nothing.
+type excluder struct {
+	m        *ignore.Matcher
+	patterns []string // --exclude patterns, saved in the backup as excludeRecord
+	files    int      // files skipped, including those inside skipped directories
+	bytes    int64    // total size of the skipped files
+}
+
+// loadExcluder reads root/.bakignore and appends the --exclude patterns,
+// which take precedence over it. It returns nil when there are no rules.
+func loadExcluder(root string, patterns []string) (*excluder, error) {
+	m := ignore.New()
+	if err := m.AddFile("", filepath.Join(root, ignoreFile)); err != nil {
+		return nil, fmt.Errorf("reading %s: %w (fix the pattern or remove the file)", ignoreFile, err)
+	}
+	if err := m.Add("", patterns); err != nil {
+		return nil, fmt.Errorf("--exclude: %w", err)
+	}
+	if m.Len() == 0 {
+		return nil, nil
+	}
+	return &excluder{m: m, patterns: patterns}, nil
+}
+
+// loadBackupExcluder returns the rules a restore from the backup at root
+// must leave alone: the backup's .bakignore and the --exclude patterns in
+// its excludeRecord, which is itself never restored. A file backup has no
+// rules.
+func loadBackupExcluder(root string) (*excluder, error) {
+	if info, err := os.Stat(root); err != nil || !info.IsDir() {
+		return nil, err
+	}
+	var lines []string
+	data, err := os.ReadFile(filepath.Join(root, excludeRecord))
+	switch {
+	case err == nil:
+		lines = append(strings.Split(string(data), "\n"), "/"+excludeRecord)
+	case !errors.Is(err, fs.ErrNotExist):
+		return nil, err
+	}
+	return loadExcluder(root, lines)
+}
+
+// checkRecordFree fails when the directory src, about to be backed up with
+// the --exclude patterns of x, has a file of its own named excludeRecord,
+// which the record would replace. Without patterns it only warns, as a
+// restore would read that file as recorded patterns.
+func checkRecordFree(src string, x *excluder, warn io.Writer) error {
+	p := filepath.Join(src, excludeRecord)
+	if _, err := os.Lstat(p); err != nil {
+		return nil
+	}
+	if x.record() != "" {
+		return fmt.Errorf("%s exists, and bak saves the --exclude patterns under that name (rename it, or back up without --exclude)", p)
+	}
+	fmt.Fprintf(warn, "%s: %s will be read as --exclude patterns when this backup is restored\n", programName, p)
+	return nil
+}
+
+// writeRecord writes the excludeRecord content rec to p, refusing to
+// replace a file already there.
+func writeRecord(p, rec string) error {
+	f, err := os.OpenFile(p, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(f, rec); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// record returns the excludeRecord content for the --exclude patterns, or
+// "" when none were given.
+func (x *excluder) record() string {
+	if x == nil || len(x.patterns) == 0 {
+		return ""
+	}
+	return "# --exclude patterns this backup was made with\n" + strings.Join(x.patterns, "\n") + "\n"
+}
+
+// matches reports whether rel, a slash-separated path below the root, or any
+// directory above it is excluded.
+func (x *excluder) matches(rel string, isDir bool) bool {
+	return x != nil && x.m.MatchParents(rel, isDir)
+}
+
+// skip reports whether the walk entry d at path p, found at rel below the
+// root, is excluded, and counts what it leaves out.
+func (x *excluder) skip(p, rel string, d fs.DirEntry) bool {
+	if x == nil || rel == "." || !x.m.Match(filepath.ToSlash(rel), d.IsDir()) {
+		return false
+	}
+	filepath.WalkDir(p, func(_ string, e fs.DirEntry, err error) error {
+		if err != nil || e.IsDir() {
+			return nil
+		}
+		x.files++
+		if info, err := e.Info(); err == nil && info.Mode().IsRegular() {
+			x.bytes += info.Size()
+		}
+		return nil
+	})
+	return true
+}
+
+// report prints how much the rules left out.
+func (x *excluder) report(w io.Writer) {
+	if x == nil {
+		return
+	}
+	fmt.Fprintf(w, "Skipped %d file(s), %s, matching ignore rules\n", x.files, bytesize.Format(x.bytes))
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBackupHonorsBakignoreAndExclude(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "app")
+	writeFiles(t, dir, map[string]string{
+		"app/.bakignore":                "node_modules/\n*.log\n!keep.log\n",
+		"app/main.go":                   "package main",
+		"app/keep.log":                  "k",
+		"app/debug.log":                 "12345",
+		"app/node_modules/x/index.js":   "123",
+		"app/web/node_modules/y/lib.js": "12",
+		"app/build/out.bin":             "1234567",
+	})
+
+	for _, ext := range []string{"", ".tar.gz"} {
+		t.Run("archive="+ext, func(t *testing.T) {
+			var out bytes.Buffer
+			target, err := createBackup(src, time.Now(), options{archive: ext, exclude: []string{"/build"}}, &out, io.Discard)
+			if err != nil {
+				t.Fatalf("createBackup: %v", err)
+			}
+			if !strings.Contains(out.String(), "Skipped 4 file(s), 17B") {
+				t.Errorf("report = %q", out.String())
+			}
+
+			root := target
+			if ext != "" {
+				root = t.TempDir()
+				if err := extractArchive(target, root); err != nil {
+					t.Fatal(err)
+				}
+				root = filepath.Join(root, "app")
+			}
+			for _, rel := range []string{".bakignore", "main.go", "keep.log"} {
+				if _, err := os.Stat(filepath.Join(root, rel)); err != nil {
+					t.Errorf("%s missing from backup: %v", rel, err)
+				}
+			}
+			for _, rel := range []string{"debug.log", "node_modules", "web/node_modules", "build"} {
+				if _, err := os.Stat(filepath.Join(root, rel)); !os.IsNotExist(err) {
+					t.Errorf("%s present in backup: %v", rel, err)
+				}
+			}
+		})
+	}
+}
+
+func TestRestoreKeepsExcludedPaths(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "app")
+	writeFiles(t, dir, map[string]string{
+		"app/.bakignore":          "node_modules/\n",
+		"app/conf":                "good",
+		"app/node_modules/dep.js": "dep",
+	})
+	if _, err := createBackup(src, time.Now(), options{}, io.Discard, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	writeFiles(t, dir, map[string]string{"app/conf": "broken"})
+
+	var out bytes.Buffer
+	if err := restoreBackup(src, "", true, &out); err != nil {
+		t.Fatalf("restoreBackup: %v", err)
+	}
+	if strings.Contains(out.String(), "node_modules") {
+		t.Errorf("excluded path reported as removed: %q", out.String())
+	}
+	if data, _ := os.ReadFile(filepath.Join(src, "conf")); string(data) != "good" {
+		t.Errorf("conf = %q, want good", data)
+	}
+	if data, _ := os.ReadFile(filepath.Join(src, "node_modules", "dep.js")); string(data) != "dep" {
+		t.Errorf("node_modules/dep.js = %q, want it kept", data)
+	}
+}
+
+func TestLoadExcluderNoRules(t *testing.T) {
+	x, err := loadExcluder(t.TempDir(), nil)
+	if err != nil || x != nil {
+		t.Fatalf("loadExcluder = %v, %v; want nil, nil", x, err)
+	}
+}
+
+func TestRestoreKeepsPathsExcludedByFlag(t *testing.T) {
+	for _, ext := range []string{"", ".tar.gz"} {
+		t.Run("archive="+ext, func(t *testing.T) {
+			dir := t.TempDir()
+			src := filepath.Join(dir, "app")
+			writeFiles(t, dir, map[string]string{
+				"app/conf":                "good",
+				"app/node_modules/dep.js": "dep",
+			})
+			opts := options{archive: ext, exclude: []string{"node_modules/"}}
+			if _, err := createBackup(src, time.Now(), opts, io.Discard, io.Discard); err != nil {
+				t.Fatal(err)
+			}
+			writeFiles(t, dir, map[string]string{"app/conf": "broken"})
+
+			var out bytes.Buffer
+			if err := restoreBackup(src, "", true, &out); err != nil {
+				t.Fatalf("restoreBackup: %v", err)
+			}
+			if strings.Contains(out.String(), "node_modules") || strings.Contains(out.String(), excludeRecord) {
+				t.Errorf("restore plan = %q", out.String())
+			}
+			if data, _ := os.ReadFile(filepath.Join(src, "node_modules", "dep.js")); string(data) != "dep" {
+				t.Errorf("node_modules/dep.js = %q, want it kept", data)
+			}
+			if _, err := os.Stat(filepath.Join(src, excludeRecord)); !os.IsNotExist(err) {
+				t.Errorf("%s restored into the source: %v", excludeRecord, err)
+			}
+		})
+	}
+}
+
+func TestRestoreFileBackup(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "conf")
+	writeFiles(t, dir, map[string]string{"conf": "good"})
+	if _, err := createBackup(src, time.Now(), options{}, io.Discard, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	writeFiles(t, dir, map[string]string{"conf": "broken"})
+	if err := restoreBackup(src, "", true, io.Discard); err != nil {
+		t.Fatalf("restoreBackup: %v", err)
+	}
+	if data, _ := os.ReadFile(src); string(data) != "good" {
+		t.Errorf("conf = %q, want good", data)
+	}
+}
+
+func TestExcludeRecordIsNotCounted(t *testing.T) {
+	for _, ext := range []string{"", ".tar.gz"} {
+		t.Run("archive="+ext, func(t *testing.T) {
+			dir := t.TempDir()
+			writeFiles(t, dir, map[string]string{"app/a.txt": "a", "app/sub/s": "s"})
+			src := filepath.Join(dir, "app")
+			if err := os.Symlink("a.txt", filepath.Join(src, "l")); err != nil {
+				t.Skipf("symlinks unavailable: %v", err)
+			}
+			opts := options{archive: ext, exclude: []string{"sub/"}}
+			if _, err := createBackup(src, time.Now(), opts, io.Discard, io.Discard); err != nil {
+				t.Fatal(err)
+			}
+			var out bytes.Buffer
+			if err := listBackups(src, &out); err != nil || !strings.Contains(out.String(), " 2 file(s)") {
+				t.Fatalf("listBackups = %q, %v; want 2 file(s)", out.String(), err)
+			}
+		})
+	}
+}
+
+func TestBackupRefusesToReplaceRecordName(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"app/" + excludeRecord: "mine"})
+	src := filepath.Join(dir, "app")
+	_, err := createBackup(src, time.Now(), options{exclude: []string{"*.log"}}, io.Discard, io.Discard)
+	if err == nil || !strings.Contains(err.Error(), excludeRecord) {
+		t.Fatalf("createBackup = %v; want an error naming %s", err, excludeRecord)
+	}
+	var warn bytes.Buffer
+	target, err := createBackup(src, time.Now(), options{}, io.Discard, &warn)
+	if err != nil || !strings.Contains(warn.String(), excludeRecord) {
+		t.Fatalf("createBackup without --exclude = %v, warnings %q", err, warn.String())
+	}
+	if data, _ := os.ReadFile(filepath.Join(target, excludeRecord)); string(data) != "mine" {
+		t.Fatalf("copied %s = %q, want mine", excludeRecord, data)
+	}
+}
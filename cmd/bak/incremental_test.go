@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sameInode reports whether a and b are hard links to the same file.
+func sameInode(t *testing.T, a, b string) bool {
+	t.Helper()
+	ia, err := os.Stat(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ib, err := os.Stat(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return os.SameFile(ia, ib)
+}
+
+func TestIncrementalLinksUnchangedFiles(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "app")
+	writeFiles(t, dir, map[string]string{"app/same": "s", "app/edit": "v1", "app/sub/deep": "d"})
+
+	day1 := time.Date(2025, 1, 1, 0, 0, 0, 0, time.Local)
+	first, err := createBackup(src, day1, options{}, io.Discard, io.Discard)
+	if err != nil {
+		t.Fatalf("first backup: %v", err)
+	}
+
+	writeFiles(t, dir, map[string]string{"app/edit": "v2", "app/new": "n"})
+	var out bytes.Buffer
+	second, err := createBackup(src, day1.AddDate(0, 0, 1), options{incr: true}, &out, io.Discard)
+	if err != nil {
+		t.Fatalf("incremental backup: %v", err)
+	}
+
+	for _, rel := range []string{"same", "sub/deep"} {
+		if !sameInode(t, filepath.Join(first, rel), filepath.Join(second, rel)) {
+			t.Errorf("%s was copied, want hard link", rel)
+		}
+	}
+	for _, rel := range []string{"edit", "new"} {
+		if _, err := os.Stat(filepath.Join(first, rel)); err == nil && sameInode(t, filepath.Join(first, rel), filepath.Join(second, rel)) {
+			t.Errorf("%s was hard-linked, want copy", rel)
+		}
+	}
+	if data, _ := os.ReadFile(filepath.Join(second, "edit")); string(data) != "v2" {
+		t.Errorf("second/edit = %q, want v2", data)
+	}
+	if !strings.Contains(out.String(), "2 file(s) hard-linked from app.20250101, 2 copied") {
+		t.Errorf("summary = %q", out.String())
+	}
+}
+
+func TestIncrementalChecksumCatchesSameStat(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "app")
+	writeFiles(t, dir, map[string]string{"app/f": "aaaa"})
+	stamp := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	if err := os.Chtimes(filepath.Join(src, "f"), stamp, stamp); err != nil {
+		t.Fatal(err)
+	}
+	day1 := time.Date(2025, 1, 1, 0, 0, 0, 0, time.Local)
+	first, err := createBackup(src, day1, options{}, io.Discard, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Same size and mtime, different bytes.
+	writeFiles(t, dir, map[string]string{"app/f": "bbbb"})
+	if err := os.Chtimes(filepath.Join(src, "f"), stamp, stamp); err != nil {
+		t.Fatal(err)
+	}
+	second, err := createBackup(src, day1.AddDate(0, 0, 1), options{incr: true, sum: true}, io.Discard, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sameInode(t, filepath.Join(first, "f"), filepath.Join(second, "f")) {
+		t.Fatal("changed file hard-linked despite --checksum")
+	}
+}
+
+func TestIncrementalRejectsFiles(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"notes": "x"})
+	_, err := createBackup(filepath.Join(dir, "notes"), time.Now(), options{incr: true}, io.Discard, io.Discard)
+	if err == nil {
+		t.Fatal("incremental backup of a file succeeded, want error")
+	}
+}
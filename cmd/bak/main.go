@@ -5,17 +5,298 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
+
+	"github.com/mattn/go-isatty"
+	"github.com/queone/governa-color"
 )
 
 const (
 	programName    = "bak"
-	programVersion = "2.0.0"
+	programVersion = "2.8.0"
 )
 
-func usage() {
-	fmt.Printf("Usage: %s <file|directory>\n", programName)
-	os.Exit(1)
+func printUsage(w io.Writer) {
+	n := color.Whi10(programName)
+	v := programVersion
+	usage := fmt.Sprintf("%s v%s\n"+
+		"Dated file and directory backups\n"+
+		"\n"+
+		"%s\n"+
+		"  %s <file|directory> [--archive[=tar.gz|zip]] [--dereference]\n"+
+		"  %s <directory> --incremental [--checksum] [--jobs N]\n"+
+		"  %s <file|directory> --encrypt\n"+
+		"  %s --decrypt <backup.tar.gz.enc> [destination] [-f]\n"+
+		"  %s --verify <archive>\n"+
+		"  %s --list <file|directory>\n"+
+		"  %s --restore <file|directory> [backup] [-f]\n"+
+		"  %s --prune <file|directory> --keep-<rule> N ... [-f]\n"+
+		"\n"+
+		"  Backups are written next to the source as <src>.YYYYMMDD, with an alphabetic\n"+
+		"  suffix (a, b, ...) when a backup for the same day already exists. Archives add\n"+
+		"  their extension (<src>.YYYYMMDD.tar.gz) and carry a SHA-256 manifest. Copies keep\n"+
+		"  symlinks, permissions, ownership and timestamps; sockets, FIFOs and devices are\n"+
+		"  skipped with a warning. A .bakignore file (gitignore syntax) at the root of a\n"+
+		"  directory, plus any --exclude patterns, leaves matching paths out of the backup.\n"+
+		"  The patterns are saved in the backup as %s, so --restore keeps those\n"+
+		"  paths as they are.\n"+
+		"  Directory copies show a live progress line when stdout is a terminal and end\n"+
+		"  with a summary of files, bytes and elapsed time.\n"+
+		"  --encrypt writes <src>.YYYYMMDD.tar.gz.enc, sealed with AES-256-GCM under a key\n"+
+		"  derived from a passphrase with scrypt. The passphrase is read from %s\n"+
+		"  when set, otherwise prompted for on the terminal.\n"+
+		"\n"+
+		"%s\n"+
+		"  -a, --archive[=FORMAT]     Write a tar.gz (default) or zip archive instead of a copy\n"+
+		"  -e, --encrypt              Write a passphrase-encrypted tar.gz archive\n"+
+		"  -L, --dereference          Copy what symlinks point to instead of the links\n"+
+		"  -x, --exclude PATTERN      Leave out paths matching a gitignore-style pattern; repeatable\n"+
+		"  -i, --incremental          Hard-link files unchanged since the newest directory backup\n"+
+		"      --checksum             With --incremental, also compare file contents before linking\n"+
+		"  -j, --jobs N               Copy up to N files at once (default: CPU count, at most 8)\n"+
+		"      --decrypt              Show what restoring an encrypted backup to its source, or to\n"+
+		"                             the given destination, would change\n"+
+		"      --verify               Re-hash an archive's files against its manifest\n"+
+		"  -l, --list                 List existing backups with date, size and file count\n"+
+		"  -r, --restore              Show what restoring a backup would change; newest if omitted\n"+
+		"  -p, --prune                Show which backups a retention policy would delete\n"+
+		"      --keep-last N          Keep the N newest backups\n"+
+		"      --keep-daily N         Keep the newest backup of each of the last N days\n"+
+		"      --keep-weekly N        Keep the newest backup of each of the last N ISO weeks\n"+
+		"      --keep-monthly N       Keep the newest backup of each of the last N months\n"+
+		"  -f                         Perform the restore, decrypt or prune (required to make changes)\n"+
+		"  -v, --version              Print version and exit\n"+
+		"  -?, --help, -h             Show this help message and exit\n"+
+		"\n"+
+		"%s\n"+
+		"  %s ~/.config/app\n"+
+		"  %s --archive=zip ~/src/project\n"+
+		"  %s --incremental ~/src/project\n"+
+		"  %s -j 4 ~/Pictures\n"+
+		"  %s -x node_modules/ -x '*.log' ~/src/project\n"+
+		"  %s --encrypt ~/.config/sms\n"+
+		"  %s --decrypt /mnt/share/sms.20250101.tar.gz.enc ~/.config/sms -f\n"+
+		"  %s --verify ~/src/project.20250101.zip\n"+
+		"  %s --list ~/.config/app\n"+
+		"  %s --restore ~/.config/app app.20250101b\n"+
+		"  %s --restore ~/.config/app -f\n"+
+		"  %s --prune ~/.config/app --keep-last 3 --keep-monthly 6\n",
+		n, v, color.Whi10("Usage"), n, n, n, n, n, n, n, n, excludeRecord, passphraseEnv,
+		color.Whi10("Options"), color.Whi10("Examples"), n, n, n, n, n, n, n, n, n, n, n, n)
+	fmt.Fprint(w, usage)
+}
+
+// options holds the parsed command line.
+type options struct {
+	list    bool
+	restore bool
+	prune   bool
+	verify  bool
+	decrypt bool
+	force   bool
+	deref   bool
+	incr    bool
+	sum     bool
+	jobs    int // concurrent file copies; 0 picks defaultJobs
+	encrypt bool
+	archive string // archive extension (".tar.gz", ".zip" or encExt); empty for a plain copy
+	exclude []string
+	keep    retention
+	paths   []string
+}
+
+// parseArgs splits args into mode flags and positional paths. Flags may
+// appear anywhere on the command line; value flags accept either
+// "--flag N" or "--flag=N".
+func parseArgs(args []string) (options, error) {
+	var opts options
+	for i := 0; i < len(args); i++ {
+		a := args[i]
+		name, value, hasValue := strings.Cut(a, "=")
+		switch {
+		case a == "-l" || a == "--list":
+			opts.list = true
+		case a == "-r" || a == "--restore":
+			opts.restore = true
+		case a == "-p" || a == "--prune":
+			opts.prune = true
+		case a == "--verify":
+			opts.verify = true
+		case a == "--decrypt":
+			opts.decrypt = true
+		case a == "-e" || a == "--encrypt":
+			opts.encrypt = true
+		case a == "-f":
+			opts.force = true
+		case a == "-L" || a == "--dereference":
+			opts.deref = true
+		case a == "-i" || a == "--incremental":
+			opts.incr = true
+		case a == "--checksum":
+			opts.sum = true
+		case name == "-x" || name == "--exclude":
+			if !hasValue {
+				if i+1 >= len(args) {
+					return opts, fmt.Errorf("%s requires a pattern (see %s --help)", name, programName)
+				}
+				i++
+				value = args[i]
+			}
+			opts.exclude = append(opts.exclude, value)
+		case name == "-a" || name == "--archive":
+			opts.archive = ".tar.gz"
+			if hasValue {
+				if value != "tar.gz" && value != "zip" {
+					return opts, fmt.Errorf("--archive: unsupported format %q; use tar.gz or zip", value)
+				}
+				opts.archive = "." + value
+			}
+		case name == "-j" || name == "--jobs":
+			if !hasValue {
+				if i+1 >= len(args) {
+					return opts, fmt.Errorf("%s requires a count (see %s --help)", name, programName)
+				}
+				i++
+				value = args[i]
+			}
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 {
+				return opts, fmt.Errorf("%s: invalid count %q; use a positive integer", name, value)
+			}
+			opts.jobs = n
+		case name == "--keep-last" || name == "--keep-daily" || name == "--keep-weekly" || name == "--keep-monthly":
+			if !hasValue {
+				if i+1 >= len(args) {
+					return opts, fmt.Errorf("%s requires a count (see %s --help)", name, programName)
+				}
+				i++
+				value = args[i]
+			}
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return opts, fmt.Errorf("%s: invalid count %q; use a non-negative integer", name, value)
+			}
+			switch name {
+			case "--keep-last":
+				opts.keep.last = n
+			case "--keep-daily":
+				opts.keep.daily = n
+			case "--keep-weekly":
+				opts.keep.weekly = n
+			case "--keep-monthly":
+				opts.keep.monthly = n
+			}
+		case strings.HasPrefix(a, "-") && a != "-":
+			return opts, fmt.Errorf("unknown flag %q (see %s --help)", a, programName)
+		default:
+			opts.paths = append(opts.paths, filepath.Clean(a))
+		}
+	}
+
+	if opts.encrypt {
+		if opts.archive == ".zip" {
+			return opts, fmt.Errorf("--encrypt writes tar.gz archives and cannot be combined with --archive=zip")
+		}
+		opts.archive = encExt
+	}
+
+	modes := 0
+	for _, m := range []bool{opts.list, opts.restore, opts.prune, opts.verify, opts.decrypt} {
+		if m {
+			modes++
+		}
+	}
+	if modes > 1 {
+		return opts, fmt.Errorf("--list, --restore, --prune, --verify and --decrypt cannot be combined (see %s --help)", programName)
+	}
+	if opts.archive != "" && modes > 0 {
+		return opts, fmt.Errorf("--archive and --encrypt only apply when creating a backup (see %s --help)", programName)
+	}
+	if (opts.deref || opts.incr || opts.jobs > 0) && (modes > 0 || opts.archive != "") {
+		return opts, fmt.Errorf("--dereference, --incremental and --jobs only apply when creating a copy (see %s --help)", programName)
+	}
+	if len(opts.exclude) > 0 && modes > 0 {
+		return opts, fmt.Errorf("--exclude only applies when creating a backup (see %s --help)", programName)
+	}
+	if opts.sum && !opts.incr {
+		return opts, fmt.Errorf("--checksum only applies to --incremental (see %s --help)", programName)
+	}
+	if opts.force && !opts.restore && !opts.prune && !opts.decrypt {
+		return opts, fmt.Errorf("-f only applies to --restore, --decrypt and --prune (see %s --help)", programName)
+	}
+	if opts.keep.set() && !opts.prune {
+		return opts, fmt.Errorf("--keep-* options only apply to --prune (see %s --help)", programName)
+	}
+	return opts, nil
+}
+
+func run(args []string, stdout, stderr io.Writer) error {
+	for _, a := range args {
+		switch a {
+		case "-?", "-h", "--help":
+			printUsage(stdout)
+			return nil
+		case "-v", "--version":
+			fmt.Fprintf(stdout, "%s v%s\n", programName, programVersion)
+			return nil
+		}
+	}
+	if len(args) == 0 {
+		printUsage(stdout)
+		return nil
+	}
+
+	opts, err := parseArgs(args)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case opts.list:
+		if len(opts.paths) != 1 {
+			return fmt.Errorf("--list expects exactly one path (see %s --help)", programName)
+		}
+		return listBackups(opts.paths[0], stdout)
+	case opts.restore:
+		if len(opts.paths) < 1 || len(opts.paths) > 2 {
+			return fmt.Errorf("--restore expects a path and an optional backup (see %s --help)", programName)
+		}
+		name := ""
+		if len(opts.paths) == 2 {
+			name = opts.paths[1]
+		}
+		return restoreBackup(opts.paths[0], name, opts.force, stdout)
+	case opts.prune:
+		if len(opts.paths) != 1 {
+			return fmt.Errorf("--prune expects exactly one path (see %s --help)", programName)
+		}
+		if !opts.keep.set() {
+			return fmt.Errorf("--prune needs at least one --keep-last, --keep-daily, --keep-weekly or --keep-monthly count")
+		}
+		return pruneBackups(opts.paths[0], opts.keep, opts.force, stdout)
+	case opts.verify:
+		if len(opts.paths) != 1 {
+			return fmt.Errorf("--verify expects exactly one archive (see %s --help)", programName)
+		}
+		return verifyArchive(opts.paths[0], stdout)
+	case opts.decrypt:
+		if len(opts.paths) < 1 || len(opts.paths) > 2 {
+			return fmt.Errorf("--decrypt expects an encrypted backup and an optional destination (see %s --help)", programName)
+		}
+		dst := ""
+		if len(opts.paths) == 2 {
+			dst = opts.paths[1]
+		}
+		return decryptBackup(opts.paths[0], dst, opts.force, stdout)
+	default:
+		if len(opts.paths) != 1 {
+			return fmt.Errorf("expected exactly one file or directory (see %s --help)", programName)
+		}
+		_, err := createBackup(opts.paths[0], time.Now(), opts, stdout, stderr)
+		return err
+	}
 }
 
 func nextSuffix(s string) string {
@@ -33,83 +314,92 @@ func nextSuffix(s string) string {
 	return "a" + string(r)
 }
 
-func copyFile(src, dst string, mode os.FileMode) error {
-	in, err := os.Open(src)
-	if err != nil {
-		return err
+// stampTaken reports whether a plain copy or any archive already uses the
+// backup name stem.
+func stampTaken(stem string) bool {
+	for _, ext := range append([]string{""}, archiveExts...) {
+		if _, err := os.Lstat(stem + ext); !os.IsNotExist(err) {
+			return true
+		}
 	}
-	defer in.Close()
+	return false
+}
 
-	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_EXCL, mode)
+// createBackup copies or archives src to the first free
+// <src>.YYYYMMDD[suffix] name for the given day and returns the path it
+// wrote.
+func createBackup(src string, now time.Time, opts options, out, warn io.Writer) (string, error) {
+	info, err := os.Stat(src)
 	if err != nil {
-		return err
+		return "", fmt.Errorf("backup failed: %w (check the path and try again)", err)
 	}
-	defer out.Close()
-
-	_, err = io.Copy(out, in)
-	return err
-}
 
-func copyDir(src, dst string) error {
-	return filepath.WalkDir(src, func(path string, d os.DirEntry, err error) error {
-		if err != nil {
-			return err
+	var x *excluder
+	if info.IsDir() {
+		if x, err = loadExcluder(src, opts.exclude); err != nil {
+			return "", err
 		}
-
-		rel, _ := filepath.Rel(src, path)
-		target := filepath.Join(dst, rel)
-
-		info, err := d.Info()
+		if err := checkRecordFree(src, x, warn); err != nil {
+			return "", err
+		}
+	}
+	c := &copier{deref: opts.deref, warn: warn, checksum: opts.sum, exclude: x, jobs: opts.jobs, record: x.record()}
+	if opts.incr {
+		if !info.IsDir() {
+			return "", fmt.Errorf("--incremental applies to directories; %s is a file", src)
+		}
+		prev, err := latestCopy(src)
 		if err != nil {
-			return err
+			return "", err
 		}
-
-		if d.IsDir() {
-			return os.MkdirAll(target, info.Mode())
+		if prev == "" {
+			fmt.Fprintf(warn, "%s: no previous directory backup of %s; making a full copy\n", programName, src)
 		}
-
-		return copyFile(path, target, info.Mode())
-	})
-}
-
-func main() {
-	if len(os.Args) == 2 && (os.Args[1] == "-v" || os.Args[1] == "--version") {
-		fmt.Printf("%s v%s\n", programName, programVersion)
-		return
-	}
-
-	if len(os.Args) != 2 {
-		usage()
+		c.linkDest = prev
 	}
 
-	src := os.Args[1]
-	info, err := os.Stat(src)
-	if err != nil {
-		usage()
-	}
-
-	date := time.Now().Format("20060102")
+	date := now.Format("20060102")
 	base := fmt.Sprintf("%s.%s", src, date)
 
 	suffix := ""
 	target := base
 
-	for {
-		if _, err := os.Stat(target); os.IsNotExist(err) {
-			break
-		}
+	for stampTaken(target) {
 		suffix = nextSuffix(suffix)
 		target = base + suffix
 	}
 
-	if info.IsDir() {
-		err = copyDir(src, target)
+	if opts.archive != "" {
+		target += opts.archive
+		err = writeArchive(src, target, opts.archive, x, warn)
 	} else {
-		err = copyFile(src, target, info.Mode())
+		var tty io.Writer
+		if f, ok := out.(*os.File); ok && isatty.IsTerminal(f.Fd()) && info.IsDir() {
+			tty = f
+		}
+		c.progress = newProgress(tty)
+		c.progress.begin()
+		c.progress.count(src, x)
+		err = c.copyPath(src, target)
+		c.progress.end()
 	}
-
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "backup failed: %v\n", err)
+		return "", fmt.Errorf("backup failed: %w", err)
+	}
+	if c.progress != nil {
+		fmt.Fprintln(out, c.progress.summary(target, time.Now()))
+	}
+	if c.linkDest != "" {
+		fmt.Fprintf(out, "%s: %d file(s) hard-linked from %s, %d copied\n",
+			target, c.linked.Load(), filepath.Base(c.linkDest), c.copied.Load())
+	}
+	x.report(out)
+	return target, nil
+}
+
+func main() {
+	if err := run(os.Args[1:], os.Stdout, os.Stderr); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", programName, err)
 		os.Exit(1)
 	}
 }
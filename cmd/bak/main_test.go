@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeFiles creates each relative path under root with the given content.
+func writeFiles(t *testing.T, root string, files map[string]string) {
+	t.Helper()
+	for rel, content := range files {
+		p := filepath.Join(root, rel)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestNextSuffix(t *testing.T) {
+	cases := map[string]string{"": "a", "a": "b", "y": "z", "ab": "ac"}
+	for in, want := range cases {
+		if got := nextSuffix(in); got != want {
+			t.Errorf("nextSuffix(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestParseArgs(t *testing.T) {
+	opts, err := parseArgs([]string{"dir/", "--restore", "-f", "dir.20250101"})
+	if err != nil {
+		t.Fatalf("parseArgs: %v", err)
+	}
+	if !opts.restore || !opts.force || len(opts.paths) != 2 || opts.paths[0] != "dir" {
+		t.Fatalf("parseArgs = %+v", opts)
+	}
+
+	opts, err = parseArgs([]string{"--prune", "x", "--keep-last", "3", "--keep-monthly=6"})
+	if err != nil {
+		t.Fatalf("parseArgs prune: %v", err)
+	}
+	if opts.keep != (retention{last: 3, monthly: 6}) {
+		t.Fatalf("parseArgs keep = %+v", opts.keep)
+	}
+
+	opts, err = parseArgs([]string{"-x", "*.log", "src", "--exclude=build/"})
+	if err != nil {
+		t.Fatalf("parseArgs exclude: %v", err)
+	}
+	if strings.Join(opts.exclude, ",") != "*.log,build/" {
+		t.Fatalf("parseArgs exclude = %q", opts.exclude)
+	}
+
+	opts, err = parseArgs([]string{"-j", "3", "src"})
+	if err != nil || opts.jobs != 3 {
+		t.Fatalf("parseArgs jobs = %d, %v", opts.jobs, err)
+	}
+
+	for _, args := range [][]string{
+		{"--list", "x", "--exclude", "y"},
+		{"--bogus", "x"},
+		{"--list", "--restore", "x"},
+		{"-f", "x"},
+		{"--keep-last", "2", "x"},
+		{"--prune", "x", "--keep-daily"},
+		{"--prune", "x", "--keep-daily=-1"},
+		{"--jobs=0", "x"},
+		{"--archive", "-j", "2", "x"},
+	} {
+		if _, err := parseArgs(args); err == nil {
+			t.Errorf("parseArgs(%q) succeeded, want error", args)
+		}
+	}
+}
+
+func TestCreateBackupPicksNextFreeName(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "notes.txt")
+	writeFiles(t, dir, map[string]string{"notes.txt": "hello"})
+	day := time.Date(2025, 1, 2, 10, 0, 0, 0, time.Local)
+
+	var got []string
+	for range 3 {
+		target, err := createBackup(src, day, options{}, io.Discard, io.Discard)
+		if err != nil {
+			t.Fatalf("createBackup: %v", err)
+		}
+		got = append(got, filepath.Base(target))
+	}
+	want := []string{"notes.txt.20250102", "notes.txt.20250102a", "notes.txt.20250102b"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("backup names = %v, want %v", got, want)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, want[2]))
+	if err != nil || string(data) != "hello" {
+		t.Fatalf("backup content = %q, %v", data, err)
+	}
+}
+
+func TestRunUnknownFlag(t *testing.T) {
+	var out bytes.Buffer
+	if err := run([]string{"--nope", "x"}, &out, &out); err == nil {
+		t.Fatal("run with unknown flag succeeded, want error")
+	}
+}
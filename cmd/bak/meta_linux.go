@@ -0,0 +1,38 @@
+//go:build linux
+
+package main
+
+import (
+	"io/fs"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// fileOwner returns the numeric owner and group recorded in info.
+func fileOwner(info fs.FileInfo) (int, int, bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return int(st.Uid), int(st.Gid), true
+}
+
+// fileAtime returns the last access time recorded in info.
+func fileAtime(info fs.FileInfo) time.Time {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return info.ModTime()
+	}
+	return time.Unix(int64(st.Atim.Sec), int64(st.Atim.Nsec))
+}
+
+// setLinkTimes sets the access and modification times of the symlink at
+// path itself rather than of what it points to.
+func setLinkTimes(path string, atime, mtime time.Time) error {
+	return unix.Lutimes(path, []unix.Timeval{
+		unix.NsecToTimeval(atime.UnixNano()),
+		unix.NsecToTimeval(mtime.UnixNano()),
+	})
+}
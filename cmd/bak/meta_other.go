@@ -0,0 +1,25 @@
+//go:build !linux && !darwin
+
+package main
+
+import (
+	"io/fs"
+	"time"
+)
+
+// fileOwner reports no owner on platforms without a portable stat layout.
+func fileOwner(info fs.FileInfo) (int, int, bool) {
+	return 0, 0, false
+}
+
+// fileAtime falls back to the modification time on platforms without a
+// portable stat layout.
+func fileAtime(info fs.FileInfo) time.Time {
+	return info.ModTime()
+}
+
+// setLinkTimes does nothing on platforms without lutimes, so symlinks there
+// get the time they were created rather than the original's.
+func setLinkTimes(path string, atime, mtime time.Time) error {
+	return nil
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/queone/utils/internal/bytesize"
+)
+
+// progress counts the files and bytes a copy has written. When given a
+// terminal it redraws a status line with files, bytes, throughput and ETA
+// until end is called.
+type progress struct {
+	tty        io.Writer    // terminal for the live line; nil stays quiet
+	totalFiles atomic.Int64 // expected totals, once counted is set
+	totalBytes atomic.Int64
+	counted    atomic.Bool
+	start      time.Time
+	files      atomic.Int64
+	bytes      atomic.Int64
+	stop       chan struct{}
+	done       chan struct{}
+}
+
+// progressInterval is how often the live line is redrawn.
+const progressInterval = 200 * time.Millisecond
+
+// newProgress returns a progress tracker, started now, with no totals yet.
+// tty may be nil.
+func newProgress(tty io.Writer) *progress {
+	return &progress{tty: tty, start: time.Now()}
+}
+
+// setTotals records the number of files and bytes the copy is expected to
+// write.
+func (p *progress) setTotals(files int, bytes int64) {
+	p.totalFiles.Store(int64(files))
+	p.totalBytes.Store(bytes)
+	p.counted.Store(true)
+}
+
+// count fills in the totals from a scanTree of root in the background, so
+// the live line starts at once even on trees that take long to walk. The
+// scan is abandoned when end is called first.
+func (p *progress) count(root string, x *excluder) {
+	if p == nil || p.stop == nil {
+		return
+	}
+	stop := p.stop
+	go func() {
+		if files, bytes, ok := scanTree(root, x, stop); ok {
+			p.setTotals(files, bytes)
+		}
+	}()
+}
+
+// add records one finished file of n bytes. It is safe on a nil progress
+// and from several goroutines.
+func (p *progress) add(n int64) {
+	if p == nil {
+		return
+	}
+	p.files.Add(1)
+	p.bytes.Add(n)
+}
+
+// begin starts redrawing the live line when p has a terminal.
+func (p *progress) begin() {
+	if p == nil || p.tty == nil {
+		return
+	}
+	p.stop = make(chan struct{})
+	p.done = make(chan struct{})
+	go func() {
+		defer close(p.done)
+		t := time.NewTicker(progressInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-p.stop:
+				fmt.Fprint(p.tty, "\r\033[K")
+				return
+			case now := <-t.C:
+				fmt.Fprint(p.tty, "\r\033[K"+p.line(now))
+			}
+		}
+	}()
+}
+
+// end stops the live line and clears it.
+func (p *progress) end() {
+	if p == nil || p.stop == nil {
+		return
+	}
+	close(p.stop)
+	<-p.done
+	p.stop = nil
+}
+
+// line formats the status at time now, e.g.
+// "120/900 files  14.2M/96.0M  7.1M/s  ETA 12s", or
+// "120 files  14.2M  7.1M/s  counting..." while the totals are unknown.
+func (p *progress) line(now time.Time) string {
+	files, bytes := p.files.Load(), p.bytes.Load()
+	elapsed := now.Sub(p.start).Seconds()
+	rate := 0.0
+	if elapsed > 0 {
+		rate = float64(bytes) / elapsed
+	}
+	if !p.counted.Load() {
+		return fmt.Sprintf("%d files  %s  %s/s  counting...", files, bytesize.Format(bytes), bytesize.Format(int64(rate)))
+	}
+	totalFiles, totalBytes := p.totalFiles.Load(), p.totalBytes.Load()
+	eta := "--"
+	if rate > 0 && totalBytes >= bytes {
+		eta = time.Duration(float64(totalBytes-bytes) / rate * float64(time.Second)).Round(time.Second).String()
+	}
+	return fmt.Sprintf("%d/%d files  %s/%s  %s/s  ETA %s",
+		files, totalFiles, bytesize.Format(bytes), bytesize.Format(totalBytes), bytesize.Format(int64(rate)), eta)
+}
+
+// summary reports what was written to target and how long it took.
+func (p *progress) summary(target string, now time.Time) string {
+	return fmt.Sprintf("%s: %d file(s), %s in %s", target, p.files.Load(),
+		bytesize.Format(p.bytes.Load()), now.Sub(p.start).Round(time.Millisecond))
+}
+
+// errScanStopped ends a scanTree walk that is no longer wanted.
+var errScanStopped = errors.New("scan stopped")
+
+// scanTree counts the regular files and symlinks under root that x does
+// not exclude, the entries the copier counts, and their regular-file bytes.
+// It gives up and reports false once stop is closed.
+func scanTree(root string, x *excluder, stop <-chan struct{}) (int, int64, bool) {
+	files, bytes := 0, int64(0)
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		select {
+		case <-stop:
+			return errScanStopped
+		default:
+		}
+		if err != nil {
+			return nil
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return nil
+		}
+		if rel != "." && x.matches(filepath.ToSlash(rel), d.IsDir()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() && d.Type()&fs.ModeSymlink == 0 {
+			return nil
+		}
+		files++
+		if info, err := d.Info(); err == nil && info.Mode().IsRegular() {
+			bytes += info.Size()
+		}
+		return nil
+	})
+	return files, bytes, err == nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/queone/governa-color"
+)
+
+// retention is a keep-last / keep-daily / keep-weekly / keep-monthly policy.
+// A zero count disables that rule.
+type retention struct {
+	last    int
+	daily   int
+	weekly  int
+	monthly int
+}
+
+// set reports whether any rule of the policy is enabled.
+func (r retention) set() bool {
+	return r.last > 0 || r.daily > 0 || r.weekly > 0 || r.monthly > 0
+}
+
+// applyRetention splits backups (oldest first, as returned by findBackups)
+// into those the policy keeps and those it drops. The returned map gives the
+// rules that keep each retained backup, keyed by path.
+func applyRetention(backups []backup, r retention) (map[string][]string, []backup) {
+	keep := map[string][]string{}
+
+	// bucketRule keeps the newest backup of each of the first n distinct
+	// buckets, walking from newest to oldest.
+	bucketRule := func(rule string, n int, key func(backup) string) {
+		seen := map[string]bool{}
+		for i := len(backups) - 1; i >= 0 && len(seen) < n; i-- {
+			k := key(backups[i])
+			if seen[k] {
+				continue
+			}
+			seen[k] = true
+			keep[backups[i].path] = append(keep[backups[i].path], rule)
+		}
+	}
+
+	for i := len(backups) - 1; i >= 0 && i >= len(backups)-r.last; i-- {
+		keep[backups[i].path] = append(keep[backups[i].path], "last")
+	}
+	bucketRule("daily", r.daily, func(b backup) string { return b.date.Format("2006-01-02") })
+	bucketRule("weekly", r.weekly, func(b backup) string {
+		y, w := b.date.ISOWeek()
+		return fmt.Sprintf("%d-W%02d", y, w)
+	})
+	bucketRule("monthly", r.monthly, func(b backup) string { return b.date.Format("2006-01") })
+
+	var drop []backup
+	for _, b := range backups {
+		if _, ok := keep[b.path]; !ok {
+			drop = append(drop, b)
+		}
+	}
+	return keep, drop
+}
+
+// removeBackup deletes a backup of src after re-checking that its name
+// follows the backup naming scheme, so nothing else can be deleted.
+func removeBackup(src string, b backup) error {
+	if filepath.Dir(b.path) != filepath.Dir(src) {
+		return fmt.Errorf("refusing to delete %s: not next to %s", b.path, src)
+	}
+	if _, ok := parseBackupName(filepath.Base(src), b.name()); !ok {
+		return fmt.Errorf("refusing to delete %s: name does not match %s.YYYYMMDD[suffix]", b.path, filepath.Base(src))
+	}
+	return os.RemoveAll(b.path)
+}
+
+// pruneBackups applies the retention policy to the backups of src, listing
+// what is kept and deleted; backups are only removed when force is set.
+func pruneBackups(src string, r retention, force bool, w io.Writer) error {
+	backups, err := findBackups(src)
+	if err != nil {
+		return err
+	}
+	if len(backups) == 0 {
+		fmt.Fprintf(w, "No backups of %s found.\n", src)
+		return nil
+	}
+
+	keep, drop := applyRetention(backups, r)
+	for i := len(backups) - 1; i >= 0; i-- {
+		b := backups[i]
+		if rules, ok := keep[b.path]; ok {
+			fmt.Fprintf(w, "  %s  %s  (%s)\n", color.Grn5("keep  "), b.name(), strings.Join(rules, ", "))
+		} else {
+			fmt.Fprintf(w, "  %s  %s\n", color.Red5("delete"), b.name())
+		}
+	}
+	fmt.Fprintf(w, "%d to keep, %d to delete\n", len(keep), len(drop))
+
+	if len(drop) == 0 {
+		return nil
+	}
+	if !force {
+		fmt.Fprint(w, color.Yel5("DRY RUN: Re-run with '-f' option to delete.\n"))
+		return nil
+	}
+	for _, b := range drop {
+		if err := removeBackup(src, b); err != nil {
+			return fmt.Errorf("prune failed: %w", err)
+		}
+	}
+	fmt.Fprintf(w, "Deleted %d backup(s) of %s\n", len(drop), src)
+	return nil
+}
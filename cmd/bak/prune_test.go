@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeBackups builds backups of "app" from YYYYMMDD[suffix] stamps, oldest first.
+func fakeBackups(t *testing.T, stamps ...string) []backup {
+	t.Helper()
+	var out []backup
+	for _, s := range stamps {
+		b, ok := parseBackupName("app", "app."+s)
+		if !ok {
+			t.Fatalf("bad stamp %q", s)
+		}
+		out = append(out, b)
+	}
+	return out
+}
+
+func keptNames(keep map[string][]string) []string {
+	var names []string
+	for p := range keep {
+		names = append(names, p)
+	}
+	slices.Sort(names)
+	return names
+}
+
+func TestApplyRetention(t *testing.T) {
+	backups := fakeBackups(t,
+		"20250105", "20250220", "20250301", "20250301a", "20250302", "20250310", "20250311", "20250311a")
+
+	cases := []struct {
+		name string
+		r    retention
+		want []string
+	}{
+		{"last", retention{last: 2}, []string{"app.20250311", "app.20250311a"}},
+		{"daily", retention{daily: 3}, []string{"app.20250302", "app.20250310", "app.20250311a"}},
+		{"weekly", retention{weekly: 2}, []string{"app.20250302", "app.20250311a"}},
+		{"monthly", retention{monthly: 3}, []string{"app.20250105", "app.20250220", "app.20250311a"}},
+		{"combined", retention{last: 1, monthly: 2}, []string{"app.20250220", "app.20250311a"}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			keep, drop := applyRetention(backups, tc.r)
+			if got := keptNames(keep); !slices.Equal(got, tc.want) {
+				t.Fatalf("kept %v, want %v", got, tc.want)
+			}
+			if len(keep)+len(drop) != len(backups) {
+				t.Fatalf("keep %d + drop %d != %d backups", len(keep), len(drop), len(backups))
+			}
+		})
+	}
+}
+
+func TestRemoveBackupRefusesForeignNames(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"app/a": "1", "app.old/a": "1"})
+	src := filepath.Join(dir, "app")
+
+	err := removeBackup(src, backup{path: filepath.Join(dir, "app.old"), date: time.Now()})
+	if err == nil || !strings.Contains(err.Error(), "refusing") {
+		t.Fatalf("removeBackup err = %v, want refusal", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "app.old")); err != nil {
+		t.Fatalf("app.old removed: %v", err)
+	}
+}
+
+func TestPruneBackupsDryRunThenForce(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"app/a":             "1",
+		"app.20250101/a":    "1",
+		"app.20250101a/a":   "1",
+		"app.20250102/a":    "1",
+		"app.20250102.keep": "not a backup",
+	})
+	src := filepath.Join(dir, "app")
+
+	var out bytes.Buffer
+	if err := pruneBackups(src, retention{last: 1}, false, &out); err != nil {
+		t.Fatalf("dry run: %v", err)
+	}
+	if !strings.Contains(out.String(), "1 to keep, 2 to delete") || !strings.Contains(out.String(), "DRY RUN") {
+		t.Fatalf("dry run output = %q", out.String())
+	}
+	if _, err := os.Stat(filepath.Join(dir, "app.20250101")); err != nil {
+		t.Fatalf("dry run deleted a backup: %v", err)
+	}
+
+	out.Reset()
+	if err := pruneBackups(src, retention{last: 1}, true, &out); err != nil {
+		t.Fatalf("prune: %v", err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	want := []string{"app", "app.20250102", "app.20250102.keep"}
+	if !slices.Equal(names, want) {
+		t.Fatalf("remaining entries = %v, want %v", names, want)
+	}
+}
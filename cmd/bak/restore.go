@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/queone/governa-color"
+)
+
+// treeDiff lists the relative paths that differ between a source and one of
+// its backups, from the point of view of restoring the backup.
+type treeDiff struct {
+	changed []string // present in both with different type or content
+	added   []string // only in the backup; restoring brings them back
+	removed []string // only in the source; restoring deletes them
+}
+
+func (d treeDiff) empty() bool {
+	return len(d.changed) == 0 && len(d.added) == 0 && len(d.removed) == 0
+}
+
+// snapshot maps every non-directory entry under root to its info, keyed by
+// slash-separated relative path. A missing root yields an empty map.
+func snapshot(root string) (map[string]fs.FileInfo, error) {
+	entries := map[string]fs.FileInfo{}
+	if _, err := os.Lstat(root); errors.Is(err, fs.ErrNotExist) {
+		return entries, nil
+	}
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		entries[filepath.ToSlash(rel)] = info
+		return nil
+	})
+	return entries, err
+}
+
+// sameContent reports whether two files of equal size hold the same bytes.
+func sameContent(a, b string) (bool, error) {
+	fa, err := os.Open(a)
+	if err != nil {
+		return false, err
+	}
+	defer fa.Close()
+	fb, err := os.Open(b)
+	if err != nil {
+		return false, err
+	}
+	defer fb.Close()
+
+	bufA := make([]byte, 64*1024)
+	bufB := make([]byte, 64*1024)
+	for {
+		na, errA := io.ReadFull(fa, bufA)
+		nb, errB := io.ReadFull(fb, bufB)
+		if na != nb || !bytes.Equal(bufA[:na], bufB[:nb]) {
+			return false, nil
+		}
+		if errA == io.EOF || errA == io.ErrUnexpectedEOF {
+			return errB == io.EOF || errB == io.ErrUnexpectedEOF, nil
+		}
+		if errA != nil {
+			return false, errA
+		}
+		if errB != nil {
+			return false, errB
+		}
+	}
+}
+
+// entryDiffers reports whether the entries at a and b differ in type or
+// content.
+func entryDiffers(a, b string, ia, ib fs.FileInfo) (bool, error) {
+	if ia.Mode().Type() != ib.Mode().Type() {
+		return true, nil
+	}
+	switch {
+	case ia.Mode()&fs.ModeSymlink != 0:
+		ta, err := os.Readlink(a)
+		if err != nil {
+			return false, err
+		}
+		tb, err := os.Readlink(b)
+		if err != nil {
+			return false, err
+		}
+		return ta != tb, nil
+	case ia.Mode().IsRegular():
+		if ia.Size() != ib.Size() {
+			return true, nil
+		}
+		same, err := sameContent(a, b)
+		return !same, err
+	}
+	return false, nil
+}
+
+// diffTrees compares the current state of src against a backup of it.
+// Paths matched by keep were left out of the backup on purpose and are not
+// reported; the restore copy skips them too.
+func diffTrees(src, backupPath string, keep *excluder) (treeDiff, error) {
+	var d treeDiff
+	cur, err := snapshot(src)
+	if err != nil {
+		return d, fmt.Errorf("reading %s: %w", src, err)
+	}
+	old, err := snapshot(backupPath)
+	if err != nil {
+		return d, fmt.Errorf("reading backup %s: %w", backupPath, err)
+	}
+
+	for rel, oi := range old {
+		if keep.matches(rel, oi.IsDir()) {
+			continue
+		}
+		ci, ok := cur[rel]
+		if !ok {
+			d.added = append(d.added, rel)
+			continue
+		}
+		differs, err := entryDiffers(filepath.Join(src, rel), filepath.Join(backupPath, rel), ci, oi)
+		if err != nil {
+			return d, fmt.Errorf("comparing %s: %w", rel, err)
+		}
+		if differs {
+			d.changed = append(d.changed, rel)
+		}
+	}
+	for rel, ci := range cur {
+		if _, ok := old[rel]; !ok && !keep.matches(rel, ci.IsDir()) {
+			d.removed = append(d.removed, rel)
+		}
+	}
+	sort.Strings(d.changed)
+	sort.Strings(d.added)
+	sort.Strings(d.removed)
+	return d, nil
+}
+
+// resolveBackup picks the backup of src named by name, which may be a path,
+// a backup file name, or a bare YYYYMMDD[suffix] stamp. An empty name
+// selects the newest backup.
+func resolveBackup(src, name string) (backup, error) {
+	backups, err := findBackups(src)
+	if err != nil {
+		return backup{}, err
+	}
+	if len(backups) == 0 {
+		return backup{}, fmt.Errorf("no backups of %s found (see %s --list)", src, programName)
+	}
+	if name == "" {
+		return backups[len(backups)-1], nil
+	}
+
+	want := filepath.Base(name)
+	for _, b := range backups {
+		if b.name() == want || b.name() == filepath.Base(src)+"."+want {
+			return b, nil
+		}
+	}
+	return backup{}, fmt.Errorf("%s is not a backup of %s (see %s --list %s)", name, src, programName, src)
+}
+
+// backupRoot returns the file or directory holding the contents of b. An
+// archive is extracted into a private (0700) directory under the system
+// temporary directory, never next to the archive, and cleanup removes it.
+func backupRoot(b backup) (string, func(), error) {
+	if b.ext == "" {
+		return b.path, func() {}, nil
+	}
+	tmp, err := os.MkdirTemp("", ".bak-extract-")
+	if err != nil {
+		return "", nil, fmt.Errorf("extracting %s: %w", b.name(), err)
+	}
+	cleanup := func() { os.RemoveAll(tmp) }
+	if err := extractArchive(b.path, tmp); err != nil {
+		cleanup()
+		return "", nil, fmt.Errorf("extracting %s: %w (try %s --verify %s)", b.name(), err, programName, b.path)
+	}
+	return filepath.Join(tmp, b.base), cleanup, nil
+}
+
+// restoreBackup shows how restoring a backup would change src and, when
+// force is set, replaces src with a copy of the backup.
+func restoreBackup(src, name string, force bool, w io.Writer) error {
+	b, err := resolveBackup(src, name)
+	if err != nil {
+		return err
+	}
+	return restoreFrom(src, b, force, w)
+}
+
+// restoreFrom does the work of restoreBackup once the backup is known; src
+// need not be the path b was made from.
+func restoreFrom(src string, b backup, force bool, w io.Writer) error {
+	root, cleanup, err := backupRoot(b)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	keep, err := loadBackupExcluder(root)
+	if err != nil {
+		return err
+	}
+	d, err := diffTrees(src, root, keep)
+	if err != nil {
+		return err
+	}
+
+	if d.empty() {
+		fmt.Fprintf(w, "%s already matches %s; nothing to restore.\n", src, b.name())
+		return nil
+	}
+
+	display := func(rel string) string {
+		if rel == "." {
+			return filepath.Base(src)
+		}
+		return rel
+	}
+	fmt.Fprintf(w, "Restoring %s from %s\n", src, color.Grn5(b.name()))
+	for _, rel := range d.changed {
+		fmt.Fprintf(w, "  %s  %s\n", color.Yel5("M"), display(rel))
+	}
+	for _, rel := range d.added {
+		fmt.Fprintf(w, "  %s  %s\n", color.Grn5("A"), display(rel))
+	}
+	for _, rel := range d.removed {
+		fmt.Fprintf(w, "  %s  %s\n", color.Red5("D"), display(rel))
+	}
+	fmt.Fprintf(w, "%d changed, %d added, %d removed\n", len(d.changed), len(d.added), len(d.removed))
+
+	if !force {
+		fmt.Fprint(w, color.Yel5("DRY RUN: Re-run with '-f' option to restore.\n"))
+		return nil
+	}
+	if err := replaceWithBackup(src, root, keep); err != nil {
+		return fmt.Errorf("restore failed: %w", err)
+	}
+	fmt.Fprintf(w, "Restored %s from %s\n", src, b.name())
+	return nil
+}
+
+// replaceWithBackup copies backupPath next to src and swaps it into place,
+// so src is never left half-written. Source paths matched by keep, which
+// the backup left out on purpose, are moved into the restored tree.
+func replaceWithBackup(src, backupPath string, keep *excluder) error {
+	tmp := src + ".bak-restore"
+	old := src + ".bak-replaced"
+	for _, p := range []string{tmp, old} {
+		if _, err := os.Lstat(p); err == nil {
+			return fmt.Errorf("%s already exists (remove it and retry)", p)
+		}
+	}
+
+	if err := (&copier{warn: io.Discard, exclude: keep}).copyPath(backupPath, tmp); err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+	if keep != nil {
+		if err := carryExcluded(src, tmp, keep); err != nil {
+			os.RemoveAll(tmp)
+			return err
+		}
+	}
+
+	hadSrc := false
+	if _, err := os.Lstat(src); err == nil {
+		hadSrc = true
+		if err := os.Rename(src, old); err != nil {
+			os.RemoveAll(tmp)
+			return err
+		}
+	}
+	if err := os.Rename(tmp, src); err != nil {
+		if hadSrc {
+			os.Rename(old, src)
+		}
+		os.RemoveAll(tmp)
+		return err
+	}
+	if hadSrc {
+		return os.RemoveAll(old)
+	}
+	return nil
+}
+
+// carryExcluded moves every top-most path under src that keep matches to the
+// same place under dst, unless dst already has something there.
+func carryExcluded(src, dst string, keep *excluder) error {
+	return filepath.WalkDir(src, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil || rel == "." || !keep.m.Match(filepath.ToSlash(rel), d.IsDir()) {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if _, err := os.Lstat(target); err == nil {
+			return nil
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		if err := os.Rename(p, target); err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDiffTrees(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"app/same":              "s",
+		"app/edited":            "new",
+		"app/extra":             "x",
+		"app.20250101/same":     "s",
+		"app.20250101/edited":   "old",
+		"app.20250101/sub/gone": "g",
+	})
+
+	d, err := diffTrees(filepath.Join(dir, "app"), filepath.Join(dir, "app.20250101"), nil)
+	if err != nil {
+		t.Fatalf("diffTrees: %v", err)
+	}
+	want := treeDiff{changed: []string{"edited"}, added: []string{"sub/gone"}, removed: []string{"extra"}}
+	if !reflect.DeepEqual(d, want) {
+		t.Fatalf("diffTrees = %+v, want %+v", d, want)
+	}
+}
+
+func TestRestoreBackupDryRunThenForce(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "app")
+	writeFiles(t, dir, map[string]string{
+		"app/conf":            "broken",
+		"app/junk":            "j",
+		"app.20250101/conf":   "v1",
+		"app.20250102/conf":   "good",
+		"app.20250102/keep/k": "k",
+	})
+
+	var out bytes.Buffer
+	if err := restoreBackup(src, "", false, &out); err != nil {
+		t.Fatalf("dry run: %v", err)
+	}
+	if !strings.Contains(out.String(), "app.20250102") || !strings.Contains(out.String(), "DRY RUN") {
+		t.Fatalf("dry run output = %q", out.String())
+	}
+	if data, _ := os.ReadFile(filepath.Join(src, "conf")); string(data) != "broken" {
+		t.Fatalf("dry run modified source: %q", data)
+	}
+
+	out.Reset()
+	if err := restoreBackup(src, "20250102", true, &out); err != nil {
+		t.Fatalf("restore: %v", err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(src, "conf")); string(data) != "good" {
+		t.Fatalf("restored conf = %q, want %q", data, "good")
+	}
+	if _, err := os.Stat(filepath.Join(src, "junk")); !os.IsNotExist(err) {
+		t.Fatalf("junk still present after restore: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(src, "keep", "k")); err != nil {
+		t.Fatalf("keep/k missing after restore: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "app.20250102", "conf")); err != nil {
+		t.Fatalf("backup consumed by restore: %v", err)
+	}
+}
+
+func TestRestoreBackupRejectsForeignName(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"app/a": "1", "app.20250101/a": "1", "other.20250101/a": "1"})
+
+	var out bytes.Buffer
+	err := restoreBackup(filepath.Join(dir, "app"), "other.20250101", false, &out)
+	if err == nil || !strings.Contains(err.Error(), "is not a backup of") {
+		t.Fatalf("restoreBackup foreign name err = %v", err)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/unicode"
+)
+
+// textFile is a text file as fr sees it: patterns match text, which is
+// UTF-8 with LF line endings, and encode turns edited text back into the
+// file's own encoding, byte-order mark and line endings.
+type textFile struct {
+	raw  []byte            // content on disk
+	text []byte            // decoded content
+	bom  []byte            // byte-order mark raw starts with, if any
+	enc  encoding.Encoding // nil for UTF-8
+	crlf []bool            // per line of text, whether it ended in CRLF; nil when none did
+}
+
+// boms are the byte-order marks fr recognizes, with the encoding each
+// announces. Files without one are read as UTF-8.
+var boms = []struct {
+	mark []byte
+	enc  encoding.Encoding
+}{
+	{[]byte{0xef, 0xbb, 0xbf}, nil},
+	{[]byte{0xff, 0xfe}, unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM)},
+	{[]byte{0xfe, 0xff}, unicode.UTF16(unicode.BigEndian, unicode.IgnoreBOM)},
+}
+
+// readText reads the file at path and decodes it. It returns nil without
+// reading further when the first sniffLen bytes do not look like text, and
+// nil for UTF-16 files that would not survive decoding and re-encoding.
+func readText(path string) (*textFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	head = head[:n]
+	tf := &textFile{}
+	for _, b := range boms {
+		if bytes.HasPrefix(head, b.mark) {
+			tf.bom, tf.enc = b.mark, b.enc
+			break
+		}
+	}
+	if tf.enc == nil && !isText(head[len(tf.bom):], n == sniffLen) {
+		return nil, nil
+	}
+	rest, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	tf.raw = append(head, rest...)
+
+	tf.text = tf.raw[len(tf.bom):]
+	if tf.enc != nil {
+		if tf.text, err = tf.enc.NewDecoder().Bytes(tf.text); err != nil {
+			return nil, nil
+		}
+		prefix := tf.text[:min(len(tf.text), sniffLen)]
+		if !isText(prefix, len(prefix) < len(tf.text)) {
+			return nil, nil
+		}
+	}
+	if bytes.Contains(tf.text, []byte("\r\n")) {
+		for line := range bytes.Lines(tf.text) {
+			if bytes.HasSuffix(line, []byte("\n")) {
+				tf.crlf = append(tf.crlf, bytes.HasSuffix(line, []byte("\r\n")))
+			}
+		}
+		tf.text = bytes.ReplaceAll(tf.text, []byte("\r\n"), []byte("\n"))
+	}
+	if tf.enc != nil {
+		if round, err := tf.encode(tf.text); err != nil || !bytes.Equal(round, tf.raw) {
+			return nil, nil
+		}
+	}
+	return tf, nil
+}
+
+// encode returns text as the file stores it. Each line gets back the
+// ending the line at the same position had; lines past the original last
+// line end the way it did.
+func (tf *textFile) encode(text []byte) ([]byte, error) {
+	if tf.crlf != nil {
+		var b bytes.Buffer
+		i := 0
+		for line := range bytes.Lines(text) {
+			if body, ok := bytes.CutSuffix(line, []byte("\n")); ok && tf.crlf[min(i, len(tf.crlf)-1)] {
+				b.Write(body)
+				b.WriteString("\r\n")
+			} else {
+				b.Write(line)
+			}
+			i++
+		}
+		text = b.Bytes()
+	}
+	if tf.enc != nil {
+		var err error
+		if text, err = tf.enc.NewEncoder().Bytes(text); err != nil {
+			return nil, err
+		}
+	}
+	return append(append([]byte{}, tf.bom...), text...), nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestReadTextDecodes(t *testing.T) {
+	cases := []struct {
+		name string
+		raw  string
+		text string
+		crlf []bool
+	}{
+		{name: "utf-8", raw: "a\nb\n", text: "a\nb\n"},
+		{name: "utf-8 bom", raw: "\xef\xbb\xbfa\n", text: "a\n"},
+		{name: "crlf", raw: "a\r\nb\r\n", text: "a\nb\n", crlf: []bool{true, true}},
+		{name: "mixed endings", raw: "a\r\nb\nc", text: "a\nb\nc", crlf: []bool{true, false}},
+		{name: "lone cr", raw: "a\rb\n", text: "a\rb\n"},
+		{name: "utf-16le", raw: "\xff\xfea\x00\r\x00\n\x00", text: "a\n", crlf: []bool{true}},
+		{name: "utf-16be", raw: "\xfe\xff\x00a\x00\n", text: "a\n"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "f")
+			if err := os.WriteFile(path, []byte(tc.raw), 0644); err != nil {
+				t.Fatal(err)
+			}
+			tf, err := readText(path)
+			if err != nil || tf == nil {
+				t.Fatalf("readText = %v, %v", tf, err)
+			}
+			if string(tf.text) != tc.text || !slices.Equal(tf.crlf, tc.crlf) {
+				t.Fatalf("text = %q, crlf = %v; want %q, %v", tf.text, tf.crlf, tc.text, tc.crlf)
+			}
+			out, err := tf.encode(tf.text)
+			if err != nil || string(out) != tc.raw {
+				t.Fatalf("encode = %q, %v; want %q", out, err, tc.raw)
+			}
+		})
+	}
+
+	path := filepath.Join(t.TempDir(), "odd")
+	if err := os.WriteFile(path, []byte("\xff\xfea\x00b"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if tf, err := readText(path); err != nil || tf != nil {
+		t.Fatalf("readText of truncated UTF-16 = %v, %v; want nil", tf, err)
+	}
+}
+
+func TestFRReplaceKeepsEncoding(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"crlf.txt":  "key = old\r\nother = old\r\n",
+		"mixed.txt": "key = old\r\nother = old\n",
+		"utf16.txt": "\xff\xfeo\x00l\x00d\x00\r\x00\n\x00",
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if out, err := runFR(t, dir, "old$", "new", "-f"); err != nil {
+		t.Fatalf("fr -f: %v\n%s", err, out)
+	}
+	assertFile(t, filepath.Join(dir, "crlf.txt"), "key = new\r\nother = new\r\n")
+	assertFile(t, filepath.Join(dir, "mixed.txt"), "key = new\r\nother = new\n")
+	assertFile(t, filepath.Join(dir, "utf16.txt"), "\xff\xfen\x00e\x00w\x00\r\x00\n\x00")
+}
+
+func TestFRMixedLineEndingsEndOfLine(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "m.txt"), []byte("a\r\nb\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := runFR(t, dir, "$", ";", "-f"); err != nil {
+		t.Fatalf("fr -f: %v\n%s", err, out)
+	}
+	assertFile(t, filepath.Join(dir, "m.txt"), "a;\r\nb;\n;")
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/queone/governa-color"
+)
+
+// diffContext is the number of unchanged lines shown around each hunk.
+const diffContext = 3
+
+// hunk is a run of matches whose lines overlap, offered for confirmation as
+// a single change.
+type hunk struct {
+	matches    [][]int  // submatch indexes of the matches, in file order
+	start, end int      // changed lines [start, end), 0-based
+	from, to   int      // byte range of the changed lines
+	old, new   []string // the changed lines before and after replacement
+}
+
+// lineIndex maps byte offsets of data to 0-based line numbers.
+type lineIndex []int
+
+func newLineIndex(data []byte) lineIndex {
+	starts := lineIndex{0}
+	for i, c := range data {
+		if c == '\n' && i+1 < len(data) {
+			starts = append(starts, i+1)
+		}
+	}
+	return starts
+}
+
+// line returns the line holding byte offset off.
+func (li lineIndex) line(off int) int {
+	return sort.Search(len(li), func(i int) bool { return li[i] > off }) - 1
+}
+
+// span returns the byte range covering lines [start, end) of data,
+// including the final line's newline.
+func (li lineIndex) span(data []byte, start, end int) (int, int) {
+	if end < len(li) {
+		return li[start], li[end]
+	}
+	return li[start], len(data)
+}
+
+// matchLines returns the first and last line touched by the match at
+// loc, inclusive.
+func (li lineIndex) matchLines(loc []int) (int, int) {
+	first := li.line(loc[0])
+	last := first
+	if loc[1] > loc[0] {
+		last = li.line(loc[1] - 1)
+	}
+	return first, last
+}
+
+// splice returns data[from:to] with each match replaced by what piece
+// returns for it. Matches must lie inside the range and be in order.
+func splice(data []byte, from, to int, matches [][]int, piece func(out []byte, loc []int) []byte) []byte {
+	var out []byte
+	pos := from
+	for _, loc := range matches {
+		out = append(out, data[pos:loc[0]]...)
+		out = piece(out, loc)
+		pos = loc[1]
+	}
+	return append(out, data[pos:to]...)
+}
+
+// expand replaces the matches in data[from:to] with the expanded template.
+func expand(data []byte, from, to int, matches [][]int, re *regexp.Regexp, tmpl string) []byte {
+	return splice(data, from, to, matches, func(out []byte, loc []int) []byte {
+		return re.Expand(out, []byte(tmpl), data, loc)
+	})
+}
+
+// markLines applies mark to each line of s separately, so color codes
+// never span a line break.
+func markLines(s string, mark func(any) string) string {
+	parts := strings.Split(s, "\n")
+	for i, p := range parts {
+		if p != "" {
+			parts[i] = mark(p)
+		}
+	}
+	return strings.Join(parts, "\n")
+}
+
+// markHunk returns the lines of h before and after replacement with the
+// matched text highlighted in red and the replacements in green.
+func markHunk(data []byte, h hunk, re *regexp.Regexp, tmpl string) (old, new []string) {
+	old = splitLines(splice(data, h.from, h.to, h.matches, func(out []byte, loc []int) []byte {
+		return append(out, markLines(string(data[loc[0]:loc[1]]), color.Red5)...)
+	}))
+	new = splitLines(splice(data, h.from, h.to, h.matches, func(out []byte, loc []int) []byte {
+		return append(out, markLines(string(re.Expand(nil, []byte(tmpl), data, loc)), color.Grn5)...)
+	}))
+	return old, new
+}
+
+// buildHunks groups the matches of re in data into hunks.
+func buildHunks(data []byte, re *regexp.Regexp, to string) []hunk {
+	li := newLineIndex(data)
+	var hunks []hunk
+	for _, loc := range re.FindAllSubmatchIndex(data, -1) {
+		first, last := li.matchLines(loc)
+		if n := len(hunks); n > 0 && first < hunks[n-1].end {
+			h := &hunks[n-1]
+			h.matches = append(h.matches, loc)
+			h.end = max(h.end, last+1)
+			continue
+		}
+		hunks = append(hunks, hunk{matches: [][]int{loc}, start: first, end: last + 1})
+	}
+	for i := range hunks {
+		h := &hunks[i]
+		h.from, h.to = li.span(data, h.start, h.end)
+		h.old = splitLines(data[h.from:h.to])
+		h.new = splitLines(expand(data, h.from, h.to, h.matches, re, to))
+	}
+	return hunks
+}
+
+// applyHunks returns data with the matches of the accepted hunks replaced.
+func applyHunks(data []byte, hunks []hunk, accepted []bool, re *regexp.Regexp, to string) []byte {
+	var matches [][]int
+	for i, h := range hunks {
+		if accepted[i] {
+			matches = append(matches, h.matches...)
+		}
+	}
+	return expand(data, 0, len(data), matches, re, to)
+}
+
+// writeHunk prints h as a colored unified diff hunk. lines is the whole
+// file and delta the line-count change of the hunks before it.
+func writeHunk(w io.Writer, lines []string, h hunk, delta int) {
+	end := min(h.end, len(lines))
+	start := min(h.start, end)
+	before := max(start-diffContext, 0)
+	after := min(end+diffContext, len(lines))
+	oldLen := after - before - (end - start) + len(h.old)
+	newLen := oldLen - len(h.old) + len(h.new)
+	fmt.Fprintln(w, color.Cya5(fmt.Sprintf("@@ -%d,%d +%d,%d @@", before+1, oldLen, before+1+delta, newLen)))
+	for _, l := range lines[before:start] {
+		fmt.Fprintf(w, " %s\n", l)
+	}
+	for _, l := range h.old {
+		fmt.Fprintln(w, color.Red5("-"+l))
+	}
+	for _, l := range h.new {
+		fmt.Fprintln(w, color.Grn5("+"+l))
+	}
+	for _, l := range lines[end:after] {
+		fmt.Fprintf(w, " %s\n", l)
+	}
+}
+
+// prompter asks the y/n/a/q question for each hunk and remembers an "all"
+// answer across files.
+type prompter struct {
+	in  *bufio.Reader
+	out io.Writer
+	all bool
+}
+
+// ask returns the answer for the current hunk: 'y', 'n' or 'q'. An "a"
+// answer, or one given earlier, counts as 'y'. End of input quits.
+func (p *prompter) ask() byte {
+	if p.all {
+		return 'y'
+	}
+	for {
+		fmt.Fprint(p.out, color.Whi10("Apply this change [y,n,a,q,?]? "))
+		line, err := p.in.ReadString('\n')
+		answer := strings.ToLower(strings.TrimSpace(line))
+		switch {
+		case answer == "y" || answer == "yes":
+			return 'y'
+		case answer == "n" || answer == "no":
+			return 'n'
+		case answer == "a" || answer == "all":
+			p.all = true
+			return 'y'
+		case answer == "q" || answer == "quit":
+			return 'q'
+		case err != nil:
+			fmt.Fprintln(p.out)
+			return 'q'
+		}
+		fmt.Fprintln(p.out, "y - apply this change\n"+
+			"n - skip this change\n"+
+			"a - apply this and every remaining change\n"+
+			"q - quit; changes already accepted are still written")
+	}
+}
+
+// reviewFile shows each hunk of path as a diff, asks whether to apply it,
+// and writes the accepted ones through the journal. It reports whether the
+// user quit.
+func reviewFile(path string, re *regexp.Regexp, to string, p *prompter, j *journal) (bool, error) {
+	tf, err := readText(path)
+	if err != nil || tf == nil {
+		return false, err
+	}
+	data := tf.text
+	hunks := buildHunks(data, re, to)
+	if len(hunks) == 0 {
+		return false, nil
+	}
+
+	lines := splitLines(data)
+	fmt.Fprintln(p.out, color.Whi10("--- "+path))
+	fmt.Fprintln(p.out, color.Whi10("+++ "+path))
+	accepted := make([]bool, len(hunks))
+	count, quit, delta := 0, false, 0
+	for i, h := range hunks {
+		writeHunk(p.out, lines, h, delta)
+		delta += len(h.new) - len(h.old)
+		answer := p.ask()
+		if answer == 'q' {
+			quit = true
+			break
+		}
+		if answer == 'y' {
+			accepted[i] = true
+			count++
+		}
+	}
+
+	if count > 0 {
+		out, err := tf.encode(applyHunks(data, hunks, accepted, re, to))
+		if err != nil {
+			return quit, err
+		}
+		if err := j.write(path, tf.raw, out); err != nil {
+			return quit, err
+		}
+	}
+	fmt.Fprintf(p.out, "%s: %d of %d change(s) applied\n", color.Yel5(path), count, len(hunks))
+	return quit, nil
+}
+
+// reviewFiles runs reviewFile over paths in order until the user quits.
+func reviewFiles(paths []string, re *regexp.Regexp, to string, j *journal, in io.Reader, out, errw io.Writer) error {
+	p := &prompter{in: bufio.NewReader(in), out: out}
+	failed := 0
+	for _, path := range paths {
+		quit, err := reviewFile(path, re, to, p, j)
+		if err != nil {
+			failed++
+			fmt.Fprintf(errw, "%s: %s: %v\n", programName, path, err)
+		}
+		if quit {
+			break
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d file(s) could not be processed", failed)
+	}
+	return nil
+}
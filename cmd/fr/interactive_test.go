@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestBuildHunks(t *testing.T) {
+	data := []byte("foo foo\nbar\nfoo\n\n\n\n\nfoo(x)\n")
+	re := regexp.MustCompile(`foo(\(\w\))?`)
+	hunks := buildHunks(data, re, "baz$1")
+
+	type summary struct {
+		start, end, matches int
+		old, new            []string
+	}
+	var got []summary
+	for _, h := range hunks {
+		got = append(got, summary{h.start, h.end, len(h.matches), h.old, h.new})
+	}
+	want := []summary{
+		{0, 1, 2, []string{"foo foo"}, []string{"baz baz"}},
+		{2, 3, 1, []string{"foo"}, []string{"baz"}},
+		{7, 8, 1, []string{"foo(x)"}, []string{"baz(x)"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("buildHunks =\n  %+v\nwant\n  %+v", got, want)
+	}
+
+	out := applyHunks(data, hunks, []bool{false, true, true}, re, "baz$1")
+	if string(out) != "foo foo\nbar\nbaz\n\n\n\n\nbaz(x)\n" {
+		t.Fatalf("applyHunks = %q", out)
+	}
+}
+
+func TestBuildHunksMultiLineMatch(t *testing.T) {
+	data := []byte("a\nb\nc\n")
+	hunks := buildHunks(data, regexp.MustCompile(`a\nb`), "ab")
+	if len(hunks) != 1 || hunks[0].start != 0 || hunks[0].end != 2 {
+		t.Fatalf("buildHunks = %+v", hunks)
+	}
+	if !reflect.DeepEqual(hunks[0].new, []string{"ab"}) {
+		t.Fatalf("new lines = %q", hunks[0].new)
+	}
+
+	var b bytes.Buffer
+	writeHunk(&b, splitLines(data), hunks[0], 0)
+	if !strings.Contains(b.String(), "@@ -1,3 +1,2 @@") {
+		t.Fatalf("hunk header missing from %q", b.String())
+	}
+}
+
+func TestFRInteractiveWritesAcceptedHunks(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{
+		"a.txt": "foo\n\nfoo\n",
+		"b.txt": "foo\n",
+		"c.txt": "foo\n",
+	})
+
+	// Skip a.txt's first hunk, take its second, take all of b.txt with "a".
+	out, err := runFRInput(t, dir, "n\ny\na\n", "foo", "bar", "-i")
+	if err != nil {
+		t.Fatalf("fr -i failed: %v\n%s", err, out)
+	}
+	for name, want := range map[string]string{"a.txt": "foo\n\nbar\n", "b.txt": "bar\n", "c.txt": "bar\n"} {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil || string(data) != want {
+			t.Errorf("%s = %q, %v; want %q", name, data, err, want)
+		}
+	}
+
+	// Quitting keeps what was accepted before and leaves the rest alone.
+	writeTree(t, dir, map[string]string{"a.txt": "foo\n\nfoo\n", "b.txt": "foo\n"})
+	if out, err := runFRInput(t, dir, "y\nq\n", "foo", "bar", "-i"); err != nil {
+		t.Fatalf("fr -i failed: %v\n%s", err, out)
+	}
+	for name, want := range map[string]string{"a.txt": "bar\n\nfoo\n", "b.txt": "foo\n"} {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil || string(data) != want {
+			t.Errorf("after quit, %s = %q, %v; want %q", name, data, err, want)
+		}
+	}
+}
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/queone/governa-color"
+)
+
+// Every run that writes files keeps a copy of each file's original content
+// in its own directory under journalDir, plus a run.json describing it.
+// While the run is going, each file and rename is appended to log.jsonl
+// instead, so an interrupted run can still be undone. --undo restores the
+// newest run and then drops it, so repeated undos walk back through
+// history.
+const (
+	runFile   = "run.json"
+	logFile   = "log.jsonl"
+	runLayout = "20060102T150405.000000000" // in UTC
+	maxRuns   = 50                          // older runs are pruned when a new one is saved
+)
+
+// runRecord is the run.json of one journaled run.
+type runRecord struct {
+	Time    time.Time      `json:"time"`
+	Dir     string         `json:"dir"` // working directory of the run
+	From    string         `json:"from"`
+	To      string         `json:"to"`
+	Files   []fileRecord   `json:"files"`
+	Renames []renameRecord `json:"renames,omitempty"` // in the order they were made
+}
+
+// fileRecord describes one file a run modified.
+type fileRecord struct {
+	Path   string `json:"path"`   // absolute path
+	Saved  string `json:"saved"`  // copy of the original, relative to the run directory
+	SHA256 string `json:"sha256"` // of the content fr wrote
+}
+
+// renameRecord describes one rename a run made, with absolute paths. Files
+// of the same run are recorded under their names before any rename.
+type renameRecord struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// logLine is one line of log.jsonl: the run itself first, then every file
+// written and rename made, in order.
+type logLine struct {
+	Run    *runRecord    `json:"run,omitempty"`
+	File   *fileRecord   `json:"file,omitempty"`
+	Rename *renameRecord `json:"rename,omitempty"`
+}
+
+// journal records the files of the current run as they are written. It is
+// safe for concurrent use.
+type journal struct {
+	dir  string // this run's directory
+	mu   sync.Mutex
+	rec  runRecord
+	next int      // number of the next saved copy
+	log  *os.File // log.jsonl of this run
+}
+
+// xdgStateDir returns the user's XDG state directory, honoring
+// XDG_STATE_HOME when set to an absolute path and falling back to
+// $HOME/.local/state otherwise.
+func xdgStateDir() (string, error) {
+	if v := os.Getenv("XDG_STATE_HOME"); v != "" && filepath.IsAbs(v) {
+		return v, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".local", "state"), nil
+}
+
+// journalDir returns the directory holding the run journals.
+func journalDir() (string, error) {
+	state, err := xdgStateDir()
+	if err != nil {
+		return "", fmt.Errorf("locating the undo journal: %w", err)
+	}
+	return filepath.Join(state, programName, "journal"), nil
+}
+
+// newJournal creates the directory for a new run.
+func newJournal(from, to string) (*journal, error) {
+	root, err := journalDir()
+	if err != nil {
+		return nil, err
+	}
+	cwd, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	dir := filepath.Join(root, now.UTC().Format(runLayout))
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("creating the undo journal: %w", err)
+	}
+	log, err := os.OpenFile(filepath.Join(dir, logFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("creating the undo journal: %w", err)
+	}
+	j := &journal{dir: dir, rec: runRecord{Time: now, Dir: cwd, From: from, To: to}, log: log}
+	if err := j.append(logLine{Run: &j.rec}); err != nil {
+		log.Close()
+		return nil, err
+	}
+	return j, nil
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// write saves orig, the current content of path, to the journal, replaces
+// the file with data and then records it, so a failed write leaves no
+// record behind.
+func (j *journal) write(path string, orig, data []byte) error {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	j.mu.Lock()
+	saved := strconv.Itoa(j.next)
+	j.next++
+	j.mu.Unlock()
+
+	if err := os.WriteFile(filepath.Join(j.dir, saved), orig, 0600); err != nil {
+		return fmt.Errorf("saving the original to the undo journal: %w", err)
+	}
+	if err := writeFile(path, data); err != nil {
+		os.Remove(filepath.Join(j.dir, saved))
+		return err
+	}
+	f := fileRecord{Path: abs, Saved: saved, SHA256: sha256Hex(data)}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.rec.Files = append(j.rec.Files, f)
+	return j.append(logLine{File: &f})
+}
+
+// rename renames from to to and records it.
+func (j *journal) rename(from, to string) error {
+	absFrom, err := filepath.Abs(from)
+	if err != nil {
+		return err
+	}
+	absTo, err := filepath.Abs(to)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(from, to); err != nil {
+		return err
+	}
+	r := renameRecord{absFrom, absTo}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.rec.Renames = append(j.rec.Renames, r)
+	return j.append(logLine{Rename: &r})
+}
+
+// append adds one line to log.jsonl. The caller holds j.mu, or is the
+// only user of j.
+func (j *journal) append(l logLine) error {
+	data, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	if _, err := j.log.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("saving the undo journal: %w", err)
+	}
+	return nil
+}
+
+// close turns log.jsonl into run.json, or removes the run directory when
+// nothing was written, and prunes runs beyond maxRuns.
+func (j *journal) close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if err := j.log.Close(); err != nil {
+		return fmt.Errorf("saving the undo journal: %w", err)
+	}
+	if len(j.rec.Files) == 0 && len(j.rec.Renames) == 0 {
+		return os.RemoveAll(j.dir)
+	}
+	sort.Slice(j.rec.Files, func(a, b int) bool { return j.rec.Files[a].Path < j.rec.Files[b].Path })
+	data, err := json.MarshalIndent(j.rec, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(j.dir, runFile+".tmp")
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("saving the undo journal: %w", err)
+	}
+	if err := os.Rename(tmp, filepath.Join(j.dir, runFile)); err != nil {
+		return fmt.Errorf("saving the undo journal: %w", err)
+	}
+	if err := os.Remove(filepath.Join(j.dir, logFile)); err != nil {
+		return fmt.Errorf("saving the undo journal: %w", err)
+	}
+	runs, err := listRuns()
+	if err != nil {
+		return err
+	}
+	for len(runs) > maxRuns {
+		os.RemoveAll(runs[0].dir)
+		runs = runs[1:]
+	}
+	return nil
+}
+
+// savedRun is a run found on disk.
+type savedRun struct {
+	dir string
+	rec runRecord
+}
+
+// loadRun reads the run in dir from its run.json or, for a run that did
+// not finish, its log.jsonl. It reports false for a directory holding no
+// run, or a run that wrote nothing.
+func loadRun(dir string) (runRecord, bool, error) {
+	var rec runRecord
+	data, err := os.ReadFile(filepath.Join(dir, runFile))
+	if err == nil {
+		if err := json.Unmarshal(data, &rec); err != nil {
+			return rec, false, fmt.Errorf("%s: %w", filepath.Join(dir, runFile), err)
+		}
+		return rec, true, nil
+	}
+	data, err = os.ReadFile(filepath.Join(dir, logFile))
+	if err != nil {
+		return rec, false, nil
+	}
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	for i, line := range lines {
+		var l logLine
+		if err := json.Unmarshal([]byte(line), &l); err != nil {
+			if i == len(lines)-1 {
+				break // cut short when the run was killed
+			}
+			return rec, false, fmt.Errorf("%s: line %d: %w", filepath.Join(dir, logFile), i+1, err)
+		}
+		switch {
+		case l.Run != nil:
+			rec = *l.Run
+		case l.File != nil:
+			rec.Files = append(rec.Files, *l.File)
+		case l.Rename != nil:
+			rec.Renames = append(rec.Renames, *l.Rename)
+		}
+	}
+	return rec, len(rec.Files) > 0 || len(rec.Renames) > 0, nil
+}
+
+// listRuns returns the journaled runs, including interrupted ones, oldest
+// first.
+func listRuns() ([]savedRun, error) {
+	root, err := journalDir()
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(root)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var runs []savedRun
+	for _, e := range entries {
+		dir := filepath.Join(root, e.Name())
+		rec, ok, err := loadRun(dir)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			runs = append(runs, savedRun{dir, rec})
+		}
+	}
+	// Ordered by the recorded time rather than by name, as directories
+	// named before runs were named in UTC follow the local clock.
+	sort.SliceStable(runs, func(a, b int) bool { return runs[a].rec.Time.Before(runs[b].rec.Time) })
+	return runs, nil
+}
+
+// printHistory lists the journaled runs, newest first.
+func printHistory(w io.Writer) error {
+	runs, err := listRuns()
+	if err != nil {
+		return err
+	}
+	if len(runs) == 0 {
+		fmt.Fprintln(w, "No runs to undo.")
+		return nil
+	}
+	for i := len(runs) - 1; i >= 0; i-- {
+		r := runs[i].rec
+		renames := ""
+		if len(r.Renames) > 0 {
+			renames = fmt.Sprintf(", %d rename(s)", len(r.Renames))
+		}
+		fmt.Fprintf(w, "%s  %4d file(s)%s  %s -> %s  %s\n", r.Time.Format("2006-01-02 15:04:05"),
+			len(r.Files), renames, color.Red5(strconv.Quote(r.From)), color.Grn5(strconv.Quote(r.To)), r.Dir)
+	}
+	return nil
+}
+
+// undoLast restores the files of the newest run. It refuses when any of
+// them changed after the run, and only writes when force is set.
+func undoLast(force bool, w io.Writer) error {
+	runs, err := listRuns()
+	if err != nil {
+		return err
+	}
+	if len(runs) == 0 {
+		return errors.New("no runs to undo (see fr --history)")
+	}
+	run := runs[len(runs)-1]
+
+	var changed []string
+	for _, f := range run.rec.Files {
+		cur, err := os.ReadFile(renamedPath(f.Path, run.rec.Renames))
+		if err != nil || sha256Hex(cur) != f.SHA256 {
+			changed = append(changed, f.Path)
+		}
+	}
+	for i, r := range run.rec.Renames {
+		later := run.rec.Renames[i+1:]
+		if to := renamedPath(r.To, later); !exists(to) {
+			changed = append(changed, to)
+		} else if from := renamedPath(r.From, later); exists(from) {
+			changed = append(changed, from)
+		}
+	}
+	if len(changed) > 0 {
+		for _, p := range changed {
+			fmt.Fprintf(w, "  %s  %s\n", color.Red5("changed"), p)
+		}
+		return fmt.Errorf("refusing to undo the run of %s: %d file(s) changed or missing since then",
+			run.rec.Time.Format("2006-01-02 15:04:05"), len(changed))
+	}
+
+	fmt.Fprintf(w, "Undoing %s -> %s from %s\n", strconv.Quote(run.rec.From), strconv.Quote(run.rec.To),
+		run.rec.Time.Format("2006-01-02 15:04:05"))
+	for i := len(run.rec.Renames) - 1; i >= 0; i-- {
+		r := run.rec.Renames[i]
+		fmt.Fprintf(w, "  %s  %s -> %s\n", color.Yel5("rename"), r.To, r.From)
+	}
+	for _, f := range run.rec.Files {
+		fmt.Fprintf(w, "  %s  %s\n", color.Yel5("restore"), f.Path)
+	}
+	if !force {
+		fmt.Fprint(w, color.Yel5("DRY RUN: Re-run with '-f' option to undo.\n"))
+		return nil
+	}
+	for i := len(run.rec.Renames) - 1; i >= 0; i-- {
+		r := run.rec.Renames[i]
+		if err := os.Rename(r.To, r.From); err != nil {
+			return err
+		}
+	}
+	for _, f := range run.rec.Files {
+		orig, err := os.ReadFile(filepath.Join(run.dir, f.Saved))
+		if err != nil {
+			return fmt.Errorf("reading the saved copy of %s: %w", f.Path, err)
+		}
+		if err := writeFile(f.Path, orig); err != nil {
+			return fmt.Errorf("restoring %s: %w", f.Path, err)
+		}
+	}
+	if err := os.RemoveAll(run.dir); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "Restored %d file(s)\n", len(run.rec.Files))
+	return nil
+}
+
+func exists(p string) bool {
+	_, err := os.Lstat(p)
+	return err == nil
+}
+
+// renamedPath returns where the file at p ended up after renames, which
+// may have renamed it or any directory above it.
+func renamedPath(p string, renames []renameRecord) string {
+	for _, r := range renames {
+		if p == r.From {
+			p = r.To
+		} else if rest, ok := strings.CutPrefix(p, r.From+string(filepath.Separator)); ok {
+			p = filepath.Join(r.To, rest)
+		}
+	}
+	return p
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFRUndoRestoresLastRun(t *testing.T) {
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{"a.txt": "foo 1\n", "b.txt": "foo 2\n"})
+	if err := os.Chmod(filepath.Join(dir, "b.txt"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, args := range [][]string{{"foo", "bar", "-f"}, {"bar", "baz", "-f"}} {
+		if out, err := runFR(t, dir, args...); err != nil {
+			t.Fatalf("fr %q failed: %v\n%s", args, err, out)
+		}
+	}
+
+	out, err := runFR(t, dir, "--history")
+	if err != nil {
+		t.Fatalf("fr --history failed: %v\n%s", err, out)
+	}
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[0], `"bar" -> "baz"`) || !strings.Contains(lines[1], "2 file(s)") {
+		t.Fatalf("history =\n%s", out)
+	}
+
+	// Without -f nothing is restored.
+	if out, err := runFR(t, dir, "--undo"); err != nil || !strings.Contains(out, "DRY RUN") {
+		t.Fatalf("fr --undo = %v\n%s", err, out)
+	}
+	assertFile(t, filepath.Join(dir, "a.txt"), "baz 1\n")
+
+	// Each undo steps back one run.
+	if out, err := runFR(t, dir, "--undo", "-f"); err != nil {
+		t.Fatalf("fr --undo -f failed: %v\n%s", err, out)
+	}
+	assertFile(t, filepath.Join(dir, "a.txt"), "bar 1\n")
+	if out, err := runFR(t, dir, "--undo", "-f"); err != nil {
+		t.Fatalf("second fr --undo -f failed: %v\n%s", err, out)
+	}
+	assertFile(t, filepath.Join(dir, "a.txt"), "foo 1\n")
+	assertFile(t, filepath.Join(dir, "b.txt"), "foo 2\n")
+	if info, err := os.Stat(filepath.Join(dir, "b.txt")); err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("b.txt mode = %v, %v; want 0600", info.Mode(), err)
+	}
+
+	if out, err := runFR(t, dir, "--undo"); err == nil || !strings.Contains(out, "no runs to undo") {
+		t.Fatalf("undo with empty journal = %v\n%s", err, out)
+	}
+}
+
+func TestFRUndoRefusesChangedFiles(t *testing.T) {
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{"a.txt": "foo\n", "b.txt": "foo\n"})
+	if out, err := runFR(t, dir, "foo", "bar", "-f"); err != nil {
+		t.Fatalf("fr failed: %v\n%s", err, out)
+	}
+	writeTree(t, dir, map[string]string{"b.txt": "edited later\n"})
+
+	out, err := runFR(t, dir, "--undo", "-f")
+	if err == nil || !strings.Contains(out, "refusing to undo") || !strings.Contains(out, "b.txt") {
+		t.Fatalf("undo over a changed file = %v\n%s", err, out)
+	}
+	assertFile(t, filepath.Join(dir, "a.txt"), "bar\n")
+	assertFile(t, filepath.Join(dir, "b.txt"), "edited later\n")
+}
+
+func TestShowOnlyRunsAreNotJournaled(t *testing.T) {
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{"a.txt": "foo\n"})
+	if out, err := runFR(t, dir, "foo", "bar"); err != nil {
+		t.Fatalf("fr failed: %v\n%s", err, out)
+	}
+	runs, err := listRuns()
+	if err != nil || len(runs) != 0 {
+		t.Fatalf("listRuns = %v, %v; want none", runs, err)
+	}
+}
+
+func TestFailedWritesAreNotJournaled(t *testing.T) {
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{"a.txt": "foo\n", "b.txt": "foo\n", "b.txt.tmp/x": ""})
+	if out, err := runFR(t, dir, "foo", "bar", "-f"); err == nil {
+		t.Fatalf("fr succeeded with b.txt blocked\n%s", out)
+	}
+	runs, err := listRuns()
+	if err != nil || len(runs) != 1 || len(runs[0].rec.Files) != 1 {
+		t.Fatalf("listRuns = %+v, %v; want one run with a.txt", runs, err)
+	}
+	if out, err := runFR(t, dir, "--undo", "-f"); err != nil {
+		t.Fatalf("fr --undo -f failed: %v\n%s", err, out)
+	}
+	assertFile(t, filepath.Join(dir, "a.txt"), "foo\n")
+	assertFile(t, filepath.Join(dir, "b.txt"), "foo\n")
+}
+
+func TestInterruptedRunCanBeUndone(t *testing.T) {
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{"a.txt": "foo\n"})
+	j, err := newJournal("foo", "bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := j.write(filepath.Join(dir, "a.txt"), []byte("foo\n"), []byte("bar\n")); err != nil {
+		t.Fatal(err)
+	}
+	// The run is never closed, as when fr is killed at an -i prompt.
+	if out, err := runFR(t, dir, "--undo", "-f"); err != nil {
+		t.Fatalf("fr --undo -f failed: %v\n%s", err, out)
+	}
+	assertFile(t, filepath.Join(dir, "a.txt"), "foo\n")
+}
+
+func TestListRunsOrdersByRecordedTime(t *testing.T) {
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+	root, err := journalDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The later run has the earlier name, as after a clock fall-back.
+	early := time.Date(2025, 11, 2, 1, 30, 0, 0, time.UTC)
+	for name, when := range map[string]time.Time{
+		"20251102T013000.000000000": early.Add(time.Hour),
+		"20251102T020000.000000000": early,
+	} {
+		rec := runRecord{Time: when, From: when.Format("15:04"), Files: []fileRecord{{Path: "/x", Saved: "0"}}}
+		data, err := json.Marshal(rec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeTree(t, root, map[string]string{filepath.Join(name, runFile): string(data)})
+	}
+	runs, err := listRuns()
+	if err != nil || len(runs) != 2 || runs[0].rec.From != "01:30" || runs[1].rec.From != "02:30" {
+		t.Fatalf("listRuns = %+v, %v; want the 01:30 run first", runs, err)
+	}
+
+	j, err := newJournal("a", "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.close()
+	if got, want := filepath.Base(j.dir), j.rec.Time.UTC().Format(runLayout); got != want {
+		t.Fatalf("run directory = %s, want %s", got, want)
+	}
+}
+
+func assertFile(t *testing.T, path, want string) {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil || string(data) != want {
+		t.Fatalf("%s = %q, %v; want %q", filepath.Base(path), data, err, want)
+	}
+}
@@ -1,13 +1,14 @@
 package main
 
 import (
-	"bufio"
+	"errors"
 	"fmt"
-	"log"
+	"io"
 	"os"
-	"os/exec"
 	"path/filepath"
-	"regexp"
+	"runtime"
+	"slices"
+	"strconv"
 	"strings"
 
 	"github.com/queone/governa-color"
@@ -15,144 +16,331 @@ import (
 
 const (
 	programName    = "fr"
-	programVersion = "1.0.2"
+	programVersion = "1.10.0"
 )
 
-// ---------------------------------------------------------------------
-// Helpers
-// ---------------------------------------------------------------------
-
-func isTextFile(path string) bool {
-	cmd := exec.Command("file", "-b", "--mime-type", path)
-	out, err := cmd.Output()
-	if err != nil {
-		return false
-	}
-	mime := strings.TrimSpace(string(out))
-	if mime == "application/xml" || mime == "application/json" {
-		return true
-	}
-	return strings.HasPrefix(mime, "text/")
-}
-
-func countMatches(data []byte, pattern string) int {
-	re, err := regexp.Compile(pattern)
-	if err != nil {
-		return 0 // invalid regex
-	}
-	return len(re.FindAllIndex(data, -1))
+func printUsage(w io.Writer) {
+	n := color.Whi10(programName)
+	v := programVersion
+	usage := fmt.Sprintf("%s v%s\n"+
+		"Find and replace across text files — https://github.com/queone/utils/blob/main/cmd/fr/README.md\n"+
+		"\n"+
+		"%s\n"+
+		"  %s <REGEX> [options]              Search-only mode\n"+
+		"  %s <FROM> <TO> [options]          Show-only mode\n"+
+		"  %s <FROM> <TO> -i [options]       Interactive mode\n"+
+		"  %s <FROM> <TO> -f [options]       Replace-and-write mode\n"+
+		"  %s <FROM> [<TO>] -- FILE...       Examine only the listed files\n"+
+		"  %s --undo [-f]                    Restore the files changed by the last run\n"+
+		"  %s --history                      List the runs that can be undone\n"+
+		"\n"+
+		"  Walks the directory tree, skipping hidden directories and anything ignored by\n"+
+		"  .gitignore or .ignore files at any level, and examines every text file. FROM\n"+
+		"  is a Go regular expression in which ^ and $ match at line boundaries; TO may\n"+
+		"  refer to groups as $1, $name or ${name}, and $$ inserts a literal $. Files\n"+
+		"  keep their encoding (UTF-8, or UTF-16 with a BOM), BOM and line endings.\n"+
+		"\n"+
+		"  Runs that write files save the originals in a journal under\n"+
+		"  $XDG_STATE_HOME/fr (default ~/.local/state/fr). --undo restores the newest\n"+
+		"  run, refusing if any of its files changed since, and can be repeated to step\n"+
+		"  further back.\n"+
+		"\n"+
+		"  Files listed after -- or read from stdin replace the walk; listed\n"+
+		"  directories are walked as usual.\n"+
+		"\n"+
+		"%s\n"+
+		"  -f                     Write the replacements or the undo (required to make changes)\n"+
+		"  -i, --interactive      Show each change as a diff and ask before writing it\n"+
+		"  -F, --fixed-strings    Treat FROM and TO as literal text, not a regex and template\n"+
+		"  -I, --ignore-case      Match FROM case-insensitively\n"+
+		"  -w, --word-regexp      Only match FROM as a whole word\n"+
+		"  -U, --multiline        Let . match newlines and label each match with its line range\n"+
+		"  -A, --after N          Show N lines of context after each match\n"+
+		"  -B, --before N         Show N lines of context before each match\n"+
+		"  -C, --context N        Show N lines of context before and after each match\n"+
+		"      --json             Print one JSON object per match, or per file written with -f\n"+
+		"      --names            Also rename files and directories whose names match FROM\n"+
+		"      --path DIR         Walk DIR instead of the current directory\n"+
+		"      --include GLOB     Only examine files matching GLOB; repeatable\n"+
+		"      --exclude GLOB     Skip paths matching GLOB; repeatable\n"+
+		"      --no-ignore        Do not honor .gitignore and .ignore files\n"+
+		"      --stdin            Read the files to examine from stdin, one per line\n"+
+		"  -0, --null             Like --stdin, with NUL-separated names (find -print0, git ls-files -z)\n"+
+		"      --undo             Show what undoing the last writing run would restore\n"+
+		"      --history          List journaled runs, newest first\n"+
+		"  -v, --version          Print version and exit\n"+
+		"  -?, --help, -h         Show this help message and exit\n"+
+		"\n"+
+		"  Globs use .gitignore syntax: '*.go' matches at any depth, 'testdata/**'\n"+
+		"  matches everything under testdata/ at the top of the walk.\n"+
+		"\n"+
+		"%s\n"+
+		"  %s 'foo.*bar'\n"+
+		"  %s -C 2 'TODO'\n"+
+		"  %s -U 'func \\w+\\(\\)\\s*\\{\\s*\\}'\n"+
+		"  %s oldName newName --include '*.go'\n"+
+		"  %s oldName newName --json\n"+
+		"  %s oldpkg newpkg --names -f\n"+
+		"  %s oldName newName -f -- main.go util.go\n"+
+		"  git ls-files -z '*.go' | %s -0 oldName newName -f\n"+
+		"  %s oldName newName -i\n"+
+		"  %s -F 'config.ini' 'settings.ini'\n"+
+		"  %s '(\\w+)\\.Get\\(' '${1}.Fetch(' -f\n"+
+		"  %s oldName newName -f --exclude 'vendor/**' --path src\n"+
+		"  %s --undo -f\n",
+		n, v, color.Whi10("Usage"), n, n, n, n, n, n, n, color.Whi10("Options"), color.Whi10("Examples"), n, n, n, n, n, n, n, n, n, n, n, n, n)
+	fmt.Fprint(w, usage)
 }
 
-func replaceAll(data []byte, pattern, to string) []byte {
-	re, err := regexp.Compile(pattern)
-	if err != nil {
-		return data // invalid regex
-	}
-	return re.ReplaceAll(data, []byte(to))
+// options holds the parsed command line.
+type options struct {
+	from       string
+	to         string
+	hasTo      bool // to was given, possibly empty
+	force      bool
+	interact   bool
+	literal    bool
+	ignoreCase bool
+	word       bool
+	multiline  bool
+	before     int
+	after      int
+	json       bool
+	names      bool
+	undo       bool
+	history    bool
+	root       string
+	noIgnore   bool
+	include    []string
+	exclude    []string
+	files      []string // listed after --
+	stdin      bool     // read the file list from stdin
+	null       bool     // the stdin list is NUL-separated
 }
 
-func highlightLine(line, pattern string) string {
-	re, err := regexp.Compile(pattern)
-	if err != nil {
-		return line // invalid regex
+// parseArgs splits args into flags, the FROM/TO patterns and the files
+// after --. Flags may appear anywhere before --; value flags accept
+// "--flag V" or "--flag=V".
+func parseArgs(args []string) (options, error) {
+	opts := options{root: "."}
+	var pos []string
+	for i := 0; i < len(args); i++ {
+		a := args[i]
+		name, value, hasValue := strings.Cut(a, "=")
+		switch {
+		case a == "--":
+			opts.files = append(opts.files, args[i+1:]...)
+			i = len(args)
+		case a == "--stdin":
+			opts.stdin = true
+		case a == "-0" || a == "--null":
+			opts.stdin, opts.null = true, true
+		case a == "-f":
+			opts.force = true
+		case a == "-i" || a == "--interactive":
+			opts.interact = true
+		case a == "-F" || a == "--fixed-strings":
+			opts.literal = true
+		case a == "-I" || a == "--ignore-case":
+			opts.ignoreCase = true
+		case a == "-w" || a == "--word-regexp":
+			opts.word = true
+		case a == "--undo":
+			opts.undo = true
+		case a == "--history":
+			opts.history = true
+		case a == "--no-ignore":
+			opts.noIgnore = true
+		case a == "--names":
+			opts.names = true
+		case a == "--json":
+			opts.json = true
+		case a == "-U" || a == "--multiline":
+			opts.multiline = true
+		case name == "-A" || name == "--after" || name == "-B" || name == "--before" || name == "-C" || name == "--context":
+			if !hasValue {
+				if i+1 >= len(args) {
+					return opts, fmt.Errorf("%s requires a line count (see %s --help)", name, programName)
+				}
+				i++
+				value = args[i]
+			}
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return opts, fmt.Errorf("%s: invalid line count %q; use a non-negative integer", name, value)
+			}
+			switch name {
+			case "-A", "--after":
+				opts.after = n
+			case "-B", "--before":
+				opts.before = n
+			default:
+				opts.before, opts.after = n, n
+			}
+		case name == "--path" || name == "--include" || name == "--exclude":
+			if !hasValue {
+				if i+1 >= len(args) {
+					return opts, fmt.Errorf("%s requires a value (see %s --help)", name, programName)
+				}
+				i++
+				value = args[i]
+			}
+			switch name {
+			case "--path":
+				opts.root = filepath.Clean(value)
+			case "--include":
+				opts.include = append(opts.include, value)
+			case "--exclude":
+				opts.exclude = append(opts.exclude, value)
+			}
+		case strings.HasPrefix(a, "-") && len(a) > 1:
+			return opts, fmt.Errorf("unknown flag %q (see %s --help)", a, programName)
+		default:
+			pos = append(pos, a)
+		}
 	}
-	return re.ReplaceAllStringFunc(line, func(m string) string {
-		return color.Red5(m)
-	})
-}
 
-// ---------------------------------------------------------------------
-// Main
-// ---------------------------------------------------------------------
-
-func main() {
-	if len(os.Args) == 2 && (os.Args[1] == "-v" || os.Args[1] == "--version") {
-		fmt.Printf("%s v%s\n", programName, programVersion)
-		return
+	if opts.undo || opts.history {
+		switch {
+		case opts.undo && opts.history:
+			return opts, fmt.Errorf("--undo and --history cannot be combined")
+		case len(pos) > 0 || len(opts.files) > 0 || opts.stdin:
+			return opts, fmt.Errorf("--undo and --history take no patterns or files (see %s --help)", programName)
+		case opts.history && opts.force:
+			return opts, fmt.Errorf("-f does not apply to --history")
+		case opts.json:
+			return opts, fmt.Errorf("--json does not apply to --undo and --history")
+		}
+		return opts, nil
 	}
 
-	var from, to string
-	var replaceMode, singleMode bool
-
-	switch len(os.Args) {
+	switch len(pos) {
+	case 1:
+		opts.from = pos[0]
 	case 2:
-		// single-argument search
-		from = os.Args[1]
-		singleMode = true
-	case 3:
-		// show-only mode
-		from = os.Args[1]
-		to = os.Args[2]
-	case 4:
-		// replace-and-write mode
-		from = os.Args[1]
-		to = os.Args[2]
-		if os.Args[3] != "-f" {
-			fmt.Fprintf(os.Stderr, "Unrecognised flag %q. Only -f is supported.\n", os.Args[3])
-			os.Exit(1)
-		}
-		replaceMode = true
+		opts.from, opts.to, opts.hasTo = pos[0], pos[1], true
 	default:
-		fmt.Fprintf(os.Stderr, "Usage:\n")
-		fmt.Fprintf(os.Stderr, "  %s <REGEX>                -> search-only mode\n", programName)
-		fmt.Fprintf(os.Stderr, "  %s <FROM> <TO>            -> show-only mode\n", programName)
-		fmt.Fprintf(os.Stderr, "  %s <FROM> <TO> -f         -> replace-and-write mode\n", programName)
-		os.Exit(1)
+		return opts, fmt.Errorf("expected a pattern and an optional replacement (see %s --help)", programName)
 	}
+	if opts.force && !opts.hasTo {
+		return opts, fmt.Errorf("-f needs a replacement: %s <FROM> <TO> -f", programName)
+	}
+	if opts.interact && !opts.hasTo {
+		return opts, fmt.Errorf("-i needs a replacement: %s <FROM> <TO> -i", programName)
+	}
+	if (opts.before > 0 || opts.after > 0) && (opts.force || opts.interact) {
+		return opts, fmt.Errorf("context lines only apply to the search and show-only modes")
+	}
+	if opts.stdin && len(opts.files) > 0 {
+		return opts, fmt.Errorf("list files after -- or on stdin, not both")
+	}
+	if opts.stdin && opts.interact {
+		return opts, fmt.Errorf("-i reads its answers from stdin, so it cannot take a file list there; list the files after --")
+	}
+	if (opts.stdin || len(opts.files) > 0) && opts.root != "." {
+		return opts, fmt.Errorf("--path cannot be combined with a file list")
+	}
+	if opts.names && !opts.hasTo {
+		return opts, fmt.Errorf("--names needs a replacement: %s <FROM> <TO> --names", programName)
+	}
+	if opts.names && (opts.interact || opts.json) {
+		return opts, fmt.Errorf("--names cannot be combined with -i or --json")
+	}
+	if opts.json && opts.interact {
+		return opts, fmt.Errorf("--json cannot be combined with -i")
+	}
+	if opts.json && (opts.before > 0 || opts.after > 0) {
+		return opts, fmt.Errorf("--json reports matches only; drop -A, -B and -C")
+	}
+	if opts.interact && opts.force {
+		return opts, fmt.Errorf("-i and -f cannot be combined; -i writes the changes you accept")
+	}
+	return opts, nil
+}
 
-	// -------------------- walk the tree --------------------
-	err := filepath.Walk(".", func(path string, info os.FileInfo, walkErr error) error {
-		if walkErr != nil {
-			return walkErr
-		}
-
-		// Skip hidden directories
-		if info.IsDir() && strings.HasPrefix(info.Name(), ".") && path != "." {
-			return filepath.SkipDir
-		}
-		if info.IsDir() || !info.Mode().IsRegular() || !isTextFile(path) {
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	for _, a := range args {
+		switch a {
+		case "-?", "-h", "--help":
+			printUsage(stdout)
+			return nil
+		case "-v", "--version":
+			fmt.Fprintf(stdout, "%s v%s\n", programName, programVersion)
 			return nil
 		}
+	}
+	if len(args) == 0 {
+		printUsage(stdout)
+		return nil
+	}
 
-		orig, err := os.ReadFile(path)
-		if err != nil {
-			return err
-		}
+	opts, err := parseArgs(args)
+	if err != nil {
+		return err
+	}
+	switch {
+	case opts.history:
+		return printHistory(stdout)
+	case opts.undo:
+		return undoLast(opts.force, stdout)
+	}
+	re, err := compilePattern(opts)
+	if err != nil {
+		return err
+	}
+	to, err := replacement(opts, re)
+	if err != nil {
+		return err
+	}
+	m := searchMode
+	switch {
+	case opts.force:
+		m = replaceMode
+	case opts.hasTo:
+		m = showMode
+	}
 
-		occ := countMatches(orig, from)
-		if occ == 0 {
-			return nil
+	f, err := newFilter(opts)
+	if err != nil {
+		return err
+	}
+	paths, dirs, err := gatherFiles(opts, f, stdin)
+	if err != nil {
+		return err
+	}
+	var plan []rename
+	if opts.names {
+		// Check every new name before writing anything.
+		if plan, err = planRenames(append(slices.Clone(paths), dirs...), re, to); err != nil {
+			return err
 		}
+	}
 
-		if replaceMode {
-			// ---------------- replacement mode ----------------
-			newContent := replaceAll(orig, from, to)
-			tmp := path + ".tmp"
-			if err := os.WriteFile(tmp, newContent, info.Mode()); err != nil {
-				return err
-			}
-			if err := os.Rename(tmp, path); err != nil {
-				return err
-			}
-			fmt.Printf("%s: %d occurrence(s) replaced\n", color.Yel5(path), occ)
-		} else if singleMode || (!replaceMode && !singleMode) {
-			// ---------------- show-only or single-arg search ----------------
-			scanner := bufio.NewScanner(strings.NewReader(string(orig)))
-			lineNum := 0
-			for scanner.Scan() {
-				lineNum++
-				line := scanner.Text()
-				if countMatches([]byte(line), from) > 0 {
-					hl := highlightLine(line, from)
-					fmt.Printf("%s:%d: %s\n", color.Yel5(path), lineNum, hl)
-				}
-			}
+	var j *journal
+	if opts.interact || m == replaceMode {
+		if j, err = newJournal(opts.from, opts.to); err != nil {
+			return err
 		}
+	}
+	if opts.interact {
+		err = reviewFiles(paths, re, to, j, stdin, stdout, stderr)
+	} else {
+		s := &scanner{re: re, to: to, mode: m, multiline: opts.multiline,
+			before: opts.before, after: opts.after, json: opts.json, journal: j}
+		err = scanFiles(paths, runtime.NumCPU(), s.scanFile, stdout, stderr)
+	}
+	if err == nil && len(plan) > 0 {
+		err = applyRenames(plan, j, stdout)
+	}
+	if j != nil {
+		err = errors.Join(err, j.close())
+	}
+	return err
+}
 
-		return nil
-	})
-
-	if err != nil {
-		log.Fatalf("walk error: %v", err)
+func main() {
+	if err := run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", programName, err)
+		os.Exit(1)
 	}
 }
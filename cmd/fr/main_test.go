@@ -4,9 +4,28 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
+	"strings"
 	"testing"
+	"time"
 )
 
+func TestMain(m *testing.M) {
+	// Keep the undo journal of test runs out of the real state directory.
+	// Helper processes inherit the parent's setting.
+	if os.Getenv("GO_WANT_HELPER_PROCESS_FR") != "1" {
+		dir, err := os.MkdirTemp("", "fr-state-")
+		if err != nil {
+			panic(err)
+		}
+		os.Setenv("XDG_STATE_HOME", dir)
+		code := m.Run()
+		os.RemoveAll(dir)
+		os.Exit(code)
+	}
+	os.Exit(m.Run())
+}
+
 func TestFRHelperProcess(t *testing.T) {
 	if os.Getenv("GO_WANT_HELPER_PROCESS_FR") != "1" {
 		return
@@ -31,11 +50,18 @@ func TestFRHelperProcess(t *testing.T) {
 
 func runFR(t *testing.T, dir string, args ...string) (string, error) {
 	t.Helper()
+	return runFRInput(t, dir, "", args...)
+}
+
+// runFRInput is runFR with input fed to the command's stdin.
+func runFRInput(t *testing.T, dir, input string, args ...string) (string, error) {
+	t.Helper()
 
 	cmdArgs := append([]string{"-test.run=TestFRHelperProcess", "--"}, args...)
 	cmd := exec.Command(os.Args[0], cmdArgs...)
 	cmd.Env = append(os.Environ(), "GO_WANT_HELPER_PROCESS_FR=1")
 	cmd.Dir = dir
+	cmd.Stdin = strings.NewReader(input)
 	out, err := cmd.CombinedOutput()
 	return string(out), err
 }
@@ -49,12 +75,11 @@ func TestCountMatches(t *testing.T) {
 	}{
 		{name: "two matches", data: []byte("foo bar foo"), pattern: "foo", want: 2},
 		{name: "regex match", data: []byte("a1 a2 a3"), pattern: `a[0-9]`, want: 3},
-		{name: "invalid regex", data: []byte("abc"), pattern: "(", want: 0},
 	}
 
 	for _, tc := range cases {
 		t.Run(tc.name, func(t *testing.T) {
-			got := countMatches(tc.data, tc.pattern)
+			got := countMatches(tc.data, regexp.MustCompile(tc.pattern))
 			if got != tc.want {
 				t.Fatalf("countMatches() = %d, want %d", got, tc.want)
 			}
@@ -72,12 +97,11 @@ func TestReplaceAll(t *testing.T) {
 	}{
 		{name: "replace literal", data: []byte("foo bar foo"), pattern: "foo", to: "baz", want: "baz bar baz"},
 		{name: "replace regex", data: []byte("a1 a2"), pattern: `a[0-9]`, to: "x", want: "x x"},
-		{name: "invalid regex unchanged", data: []byte("abc"), pattern: "(", to: "x", want: "abc"},
 	}
 
 	for _, tc := range cases {
 		t.Run(tc.name, func(t *testing.T) {
-			got := string(replaceAll(tc.data, tc.pattern, tc.to))
+			got := string(replaceAll(tc.data, regexp.MustCompile(tc.pattern), tc.to))
 			if got != tc.want {
 				t.Fatalf("replaceAll() = %q, want %q", got, tc.want)
 			}
@@ -124,3 +148,109 @@ func TestFRReplaceModeUpdatesTextFiles(t *testing.T) {
 		}
 	}
 }
+
+func TestIsText(t *testing.T) {
+	euro := []byte("price: \u20ac")
+	cases := []struct {
+		name      string
+		data      []byte
+		truncated bool
+		want      bool
+	}{
+		{name: "ascii", data: []byte("hello\n"), want: true},
+		{name: "utf-8", data: euro, want: true},
+		{name: "empty", data: nil, want: true},
+		{name: "nul byte", data: []byte("a\x00b"), want: false},
+		{name: "latin-1", data: []byte("caf\xe9 au lait"), want: false},
+		{name: "cut rune at prefix end", data: euro[:len(euro)-1], truncated: true, want: true},
+		{name: "cut rune at file end", data: euro[:len(euro)-1], want: false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := isText(tc.data, tc.truncated); got != tc.want {
+				t.Fatalf("isText(%q, %v) = %v, want %v", tc.data, tc.truncated, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestScanFilesKeepsPathOrder(t *testing.T) {
+	paths := []string{"a", "b", "c", "d", "e", "f"}
+	scan := func(p string) (string, error) {
+		// Finish the early paths last to shake out ordering bugs.
+		time.Sleep(time.Duration('g'-p[0]) * time.Millisecond)
+		return p + "\n", nil
+	}
+	var out, errOut strings.Builder
+	if err := scanFiles(paths, 4, scan, &out, &errOut); err != nil {
+		t.Fatalf("scanFiles: %v", err)
+	}
+	if got := out.String(); got != "a\nb\nc\nd\ne\nf\n" {
+		t.Fatalf("output order = %q", got)
+	}
+}
+
+func TestFRRejectsInvalidPattern(t *testing.T) {
+	want := "fr: invalid pattern \"fo(o\": missing closing ): `fo(o` (escape special characters with \\ or use -F to match literally)\n"
+	for _, args := range [][]string{{"fo(o", "x"}, {"fo(o", "x", "-w", "-I", "-U"}} {
+		out, err := runFR(t, t.TempDir(), args...)
+		if err == nil || out != want {
+			t.Fatalf("fr %q: err = %v, output = %q, want %q", args, err, out, want)
+		}
+	}
+}
+
+func TestFRSearchContextLines(t *testing.T) {
+	dir := t.TempDir()
+	lines := "one\ntwo\nhit\nfour\nfive\nsix\nseven\nhit\nnine\n"
+	if err := os.WriteFile(filepath.Join(dir, "a.txt"), []byte(lines), 0644); err != nil {
+		t.Fatal(err)
+	}
+	out, err := runFR(t, dir, "-C", "1", "hit")
+	if err != nil {
+		t.Fatalf("fr -C 1: %v\n%s", err, out)
+	}
+	want := "a.txt-2- two\na.txt:3: hit\na.txt-4- four\n--\na.txt-7- seven\na.txt:8: hit\na.txt-9- nine\n"
+	if out != want {
+		t.Fatalf("output = %q, want %q", out, want)
+	}
+}
+
+func TestFRMultilineLabelsLineRange(t *testing.T) {
+	dir := t.TempDir()
+	src := "func a() {\n}\n\nfunc b() { return }\n"
+	if err := os.WriteFile(filepath.Join(dir, "a.go"), []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+	out, err := runFR(t, dir, "-U", `func \w+\(\) \{\s*\}`)
+	if err != nil {
+		t.Fatalf("fr -U: %v\n%s", err, out)
+	}
+	if want := "a.go:1-2: func a() {\n          }\n"; out != want {
+		t.Fatalf("output = %q, want %q", out, want)
+	}
+}
+
+func TestFRJSONOutput(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "a.txt"), []byte("id := 1\nx, id := 2, 3\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	out, err := runFR(t, dir, `(\w+) :=`, "$1 =", "--json")
+	if err != nil {
+		t.Fatalf("fr --json: %v\n%s", err, out)
+	}
+	want := `{"path":"a.txt","line":1,"column":1,"end_line":1,"match":"id :=","replacement":"id ="}` + "\n" +
+		`{"path":"a.txt","line":2,"column":4,"end_line":2,"match":"id :=","replacement":"id ="}` + "\n"
+	if out != want {
+		t.Fatalf("show-only output = %q, want %q", out, want)
+	}
+
+	out, err = runFR(t, dir, `(\w+) :=`, "$1 =", "--json", "-f")
+	if err != nil {
+		t.Fatalf("fr --json -f: %v\n%s", err, out)
+	}
+	if want := `{"path":"a.txt","replacements":2}` + "\n"; out != want {
+		t.Fatalf("replace output = %q, want %q", out, want)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/queone/governa-color"
+)
+
+// rename is one planned file or directory rename.
+type rename struct {
+	from, to string
+}
+
+// planRenames applies re and to to the base name of each path and returns
+// the resulting renames bottom-up, children before their parents, so every
+// rename still sees the original names of the directories above it. It
+// refuses the whole plan when a new name is unusable, already exists, or
+// is shared by two renames.
+func planRenames(paths []string, re *regexp.Regexp, to string) ([]rename, error) {
+	var plan []rename
+	var errs []error
+	targets := map[string]string{}
+	for _, p := range paths {
+		base := filepath.Base(p)
+		name := re.ReplaceAllString(base, to)
+		if name == base {
+			continue
+		}
+		if name == "" || name == "." || name == ".." || strings.ContainsRune(name, filepath.Separator) || strings.ContainsRune(name, '/') {
+			errs = append(errs, fmt.Errorf("%s: %q is not a valid name", p, name))
+			continue
+		}
+		target := filepath.Join(filepath.Dir(p), name)
+		if other, ok := targets[target]; ok {
+			errs = append(errs, fmt.Errorf("%s and %s would both be renamed to %s", other, p, target))
+			continue
+		}
+		targets[target] = p
+		if info, err := os.Lstat(target); err == nil {
+			// A name that differs only in case on a case-insensitive file
+			// system still refers to the file itself.
+			if self, err := os.Lstat(p); err != nil || !os.SameFile(info, self) {
+				errs = append(errs, fmt.Errorf("%s: %s already exists", p, target))
+				continue
+			}
+		}
+		plan = append(plan, rename{p, target})
+	}
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("refusing to rename: %w", errors.Join(errs...))
+	}
+	depth := func(p string) int { return strings.Count(filepath.ToSlash(p), "/") }
+	sort.SliceStable(plan, func(a, b int) bool { return depth(plan[a].from) > depth(plan[b].from) })
+	return plan, nil
+}
+
+// applyRenames prints the renames of plan and, when j is not nil, carries
+// them out through the journal.
+func applyRenames(plan []rename, j *journal, w io.Writer) error {
+	for _, r := range plan {
+		if j != nil {
+			if err := j.rename(r.from, r.to); err != nil {
+				return err
+			}
+		}
+		fmt.Fprintf(w, "%s  %s -> %s\n", color.Yel5("rename"), r.from, color.Grn5(r.to))
+	}
+	return nil
+}
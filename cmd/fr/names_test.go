@@ -0,0 +1,80 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestPlanRenames(t *testing.T) {
+	root := t.TempDir()
+	writeTree(t, root, map[string]string{
+		"oldpkg/oldpkg.go":      "",
+		"oldpkg/sub/oldpkg.txt": "",
+		"other.go":              "",
+	})
+	re := regexp.MustCompile("oldpkg")
+	paths := []string{
+		filepath.Join(root, "oldpkg"),
+		filepath.Join(root, "oldpkg", "oldpkg.go"),
+		filepath.Join(root, "oldpkg", "sub"),
+		filepath.Join(root, "oldpkg", "sub", "oldpkg.txt"),
+		filepath.Join(root, "other.go"),
+	}
+	plan, err := planRenames(paths, re, "newpkg")
+	if err != nil {
+		t.Fatalf("planRenames: %v", err)
+	}
+	var got []string
+	for _, r := range plan {
+		got = append(got, strings.Join(relPaths(t, root, []string{r.from, r.to}), " -> "))
+	}
+	want := []string{
+		"oldpkg/sub/oldpkg.txt -> oldpkg/sub/newpkg.txt",
+		"oldpkg/oldpkg.go -> oldpkg/newpkg.go",
+		"oldpkg -> newpkg",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("plan =\n  %v\nwant\n  %v", got, want)
+	}
+
+	writeTree(t, root, map[string]string{"oldpkg/newpkg.go": ""})
+	if _, err := planRenames(paths, re, "newpkg"); err == nil || !strings.Contains(err.Error(), "already exists") {
+		t.Fatalf("planRenames onto an existing file = %v", err)
+	}
+	if _, err := planRenames(paths[3:], regexp.MustCompile(`\w+\.txt`), "a/b"); err == nil {
+		t.Fatal("planRenames accepted a name with a separator")
+	}
+	twins := []string{filepath.Join(root, "other.go"), filepath.Join(root, "oldpkg")}
+	if _, err := planRenames(twins, regexp.MustCompile(`.+`), "same"); err == nil || !strings.Contains(err.Error(), "both") {
+		t.Fatalf("planRenames with a shared target = %v", err)
+	}
+}
+
+func TestFRNamesRenamesAndUndo(t *testing.T) {
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{"oldpkg/oldpkg.go": "package oldpkg\n"})
+
+	out, err := runFR(t, dir, "oldpkg", "newpkg", "--names")
+	if err != nil || !strings.Contains(out, "rename  oldpkg -> newpkg") {
+		t.Fatalf("fr --names preview = %v\n%s", err, out)
+	}
+	assertFile(t, filepath.Join(dir, "oldpkg", "oldpkg.go"), "package oldpkg\n")
+
+	if out, err := runFR(t, dir, "oldpkg", "newpkg", "--names", "-f"); err != nil {
+		t.Fatalf("fr --names -f: %v\n%s", err, out)
+	}
+	assertFile(t, filepath.Join(dir, "newpkg", "newpkg.go"), "package newpkg\n")
+	if _, err := os.Stat(filepath.Join(dir, "oldpkg")); !os.IsNotExist(err) {
+		t.Fatalf("oldpkg still exists: %v", err)
+	}
+
+	if out, err := runFR(t, dir, "--undo", "-f"); err != nil {
+		t.Fatalf("fr --undo -f: %v\n%s", err, out)
+	}
+	assertFile(t, filepath.Join(dir, "oldpkg", "oldpkg.go"), "package oldpkg\n")
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"regexp/syntax"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// compilePattern builds the search regexp from the FROM argument and the
+// matching flags. ^ and $ always match at line boundaries, so searching,
+// previewing and writing agree on what matches; in multiline mode . also
+// matches a newline.
+func compilePattern(opts options) (*regexp.Regexp, error) {
+	expr := opts.from
+	if opts.literal {
+		expr = regexp.QuoteMeta(expr)
+	} else if _, err := syntax.Parse(expr, syntax.Perl); err != nil {
+		// Parsed alone first, so the error quotes what the user typed
+		// rather than the expression with flags and -w added.
+		return nil, patternError(opts.from, err)
+	}
+	if opts.word {
+		expr = `\b(?:` + expr + `)\b`
+	}
+	flags := "m"
+	if opts.ignoreCase {
+		flags += "i"
+	}
+	if opts.multiline {
+		flags += "s"
+	}
+	re, err := regexp.Compile("(?" + flags + ")" + expr)
+	if err != nil {
+		return nil, patternError(opts.from, err)
+	}
+	return re, nil
+}
+
+// patternError reports that the FROM argument from does not compile.
+func patternError(from string, err error) error {
+	msg := strings.TrimPrefix(err.Error(), "error parsing regexp: ")
+	return fmt.Errorf("invalid pattern %q: %s (escape special characters with \\ or use -F to match literally)", from, msg)
+}
+
+// replacement returns the template that TO becomes for re: with -F every $
+// is literal, otherwise each $1, $name or ${name} reference must name a
+// group of the pattern.
+func replacement(opts options, re *regexp.Regexp) (string, error) {
+	if opts.literal {
+		return strings.ReplaceAll(opts.to, "$", "$$"), nil
+	}
+	for _, ref := range templateRefs(opts.to) {
+		if n, err := strconv.Atoi(ref); err == nil {
+			if n > re.NumSubexp() {
+				return "", fmt.Errorf("replacement refers to $%d but the pattern has %d group(s)", n, re.NumSubexp())
+			}
+			continue
+		}
+		if !slices.Contains(re.SubexpNames(), ref) {
+			hint := ""
+			if i := strings.IndexFunc(ref, func(r rune) bool { return r < '0' || r > '9' }); i > 0 {
+				hint = fmt.Sprintf(" (write ${%s}%s to follow a group with text)", ref[:i], ref[i:])
+			}
+			return "", fmt.Errorf("replacement refers to ${%s}, which is not a group in the pattern%s", ref, hint)
+		}
+	}
+	return opts.to, nil
+}
+
+// templateRefs returns the group names and numbers referenced by a
+// regexp.Expand template, in the same way Expand reads them: $$ is a
+// literal $, and $name takes the longest run of letters, digits and
+// underscores.
+func templateRefs(tmpl string) []string {
+	isName := func(c byte) bool {
+		return c == '_' || '0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+	}
+	var refs []string
+	for i := 0; i < len(tmpl); i++ {
+		if tmpl[i] != '$' || i+1 >= len(tmpl) {
+			continue
+		}
+		switch rest := tmpl[i+1:]; {
+		case rest[0] == '$':
+			i++
+		case rest[0] == '{':
+			if end := strings.IndexByte(rest, '}'); end > 1 && strings.IndexFunc(rest[1:end], func(r rune) bool { return r > 127 || !isName(byte(r)) }) < 0 {
+				refs = append(refs, rest[1:end])
+				i += end + 1
+			}
+		default:
+			n := 0
+			for n < len(rest) && isName(rest[n]) {
+				n++
+			}
+			if n > 0 {
+				refs = append(refs, rest[:n])
+				i += n
+			}
+		}
+	}
+	return refs
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCompilePattern(t *testing.T) {
+	cases := []struct {
+		name string
+		opts options
+		data string
+		want int
+	}{
+		{name: "regex dot", opts: options{from: "a.b"}, data: "a.b axb", want: 2},
+		{name: "literal dot", opts: options{from: "a.b", literal: true}, data: "a.b axb", want: 1},
+		{name: "ignore case", opts: options{from: "foo", ignoreCase: true}, data: "Foo FOO foo", want: 3},
+		{name: "whole word", opts: options{from: "id", word: true}, data: "id idx uid id_x (id)", want: 2},
+		{name: "line anchors", opts: options{from: "^x$"}, data: "x\nyx\nx\n", want: 2},
+		{name: "dot stops at newline", opts: options{from: "a.b"}, data: "a\nb", want: 0},
+		{name: "multiline dot", opts: options{from: "a.b", multiline: true}, data: "a\nb", want: 1},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			re, err := compilePattern(tc.opts)
+			if err != nil {
+				t.Fatalf("compilePattern: %v", err)
+			}
+			if got := countMatches([]byte(tc.data), re); got != tc.want {
+				t.Fatalf("countMatches = %d, want %d", got, tc.want)
+			}
+		})
+	}
+
+	_, err := compilePattern(options{from: "foo("})
+	if err == nil || !strings.Contains(err.Error(), `invalid pattern "foo("`) || !strings.Contains(err.Error(), "-F") {
+		t.Fatalf("invalid pattern error = %v", err)
+	}
+}
+
+func TestReplacementChecksGroups(t *testing.T) {
+	re, err := compilePattern(options{from: `(?P<key>\w+)=(\d+)`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, to := range []string{"$1", "${key}:$2", "$key", "cost $$5", "${2}x"} {
+		if _, err := replacement(options{to: to}, re); err != nil {
+			t.Errorf("replacement(%q): %v", to, err)
+		}
+	}
+	for to, want := range map[string]string{
+		"$3":      "pattern has 2 group(s)",
+		"${nope}": "not a group",
+		"$1x":     "write ${1}x",
+	} {
+		if _, err := replacement(options{to: to}, re); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("replacement(%q) error = %v, want %q", to, err, want)
+		}
+	}
+
+	lit, err := replacement(options{to: "$1", literal: true}, re)
+	if err != nil || lit != "$$1" {
+		t.Fatalf("literal replacement = %q, %v", lit, err)
+	}
+}
+
+func TestTemplateRefs(t *testing.T) {
+	got := templateRefs("$1 ${name}x $$ $ ${} $a_b2-")
+	want := []string{"1", "name", "a_b2"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("templateRefs = %q, want %q", got, want)
+	}
+}
+
+func TestFRShowOnlyPreviewsExpansion(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "a.go"), []byte("x := cfg.Get(\"k\")\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	out, err := runFR(t, dir, `(\w+)\.Get\(`, "${1}.Fetch(")
+	if err != nil {
+		t.Fatalf("fr failed: %v\n%s", err, out)
+	}
+	for _, want := range []string{`a.go:1: - x := cfg.Get("k")`, `a.go:1: + x := cfg.Fetch("k")`} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output missing %q:\n%s", want, out)
+		}
+	}
+}
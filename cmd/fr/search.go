@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/queone/governa-color"
+)
+
+// sniffLen is how much of a file isText inspects, the same prefix git
+// looks at to tell text from binary.
+const sniffLen = 8000
+
+// mode selects what fr does with each file that matches.
+type mode int
+
+const (
+	searchMode  mode = iota // print matching lines
+	showMode                // print matching lines without writing
+	replaceMode             // write the replacements
+)
+
+// isText reports whether prefix, the start of a file, looks like text: it
+// holds no NUL bytes and is valid UTF-8. truncated means the file goes on
+// past prefix, so a multi-byte character may be cut off at the end.
+func isText(prefix []byte, truncated bool) bool {
+	if bytes.IndexByte(prefix, 0) >= 0 {
+		return false
+	}
+	if truncated {
+		for i := 1; i < utf8.UTFMax && i <= len(prefix); i++ {
+			if utf8.RuneStart(prefix[len(prefix)-i]) {
+				if !utf8.FullRune(prefix[len(prefix)-i:]) {
+					prefix = prefix[:len(prefix)-i]
+				}
+				break
+			}
+		}
+	}
+	return utf8.Valid(prefix)
+}
+
+func countMatches(data []byte, re *regexp.Regexp) int {
+	return len(re.FindAllIndex(data, -1))
+}
+
+func replaceAll(data []byte, re *regexp.Regexp, to string) []byte {
+	return re.ReplaceAll(data, []byte(to))
+}
+
+// splitLines splits data into lines without their line endings.
+func splitLines(data []byte) []string {
+	s := strings.TrimSuffix(string(data), "\n")
+	if s == "" {
+		return nil
+	}
+	lines := strings.Split(s, "\n")
+	for i, l := range lines {
+		lines[i] = strings.TrimSuffix(l, "\r")
+	}
+	return lines
+}
+
+// writeFile replaces the file at path with data through a temporary file
+// and a rename, keeping its permission bits.
+func writeFile(path string, data []byte) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, info.Mode().Perm()); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// scanner holds the settings scanFile applies to every file.
+type scanner struct {
+	re        *regexp.Regexp
+	to        string
+	mode      mode
+	multiline bool     // label each match with its line range
+	before    int      // context lines shown before each match
+	after     int      // context lines shown after each match
+	json      bool     // print JSON Lines records instead of text
+	journal   *journal // records writes in replaceMode
+}
+
+// scanFile searches one file for s.re and returns what to print for it. In
+// replaceMode it also writes the replaced content, through the journal.
+// Binary files yield nothing.
+func (s *scanner) scanFile(path string) (string, error) {
+	tf, err := readText(path)
+	if err != nil || tf == nil {
+		return "", err
+	}
+	data := tf.text
+	occ := countMatches(data, s.re)
+	if occ == 0 {
+		return "", nil
+	}
+
+	var b strings.Builder
+	if s.mode == replaceMode {
+		out, err := tf.encode(replaceAll(data, s.re, s.to))
+		if err != nil {
+			return "", err
+		}
+		if err := s.journal.write(path, tf.raw, out); err != nil {
+			return "", err
+		}
+		if s.json {
+			return jsonLine(replaceRecord{Path: path, Replacements: occ})
+		}
+		fmt.Fprintf(&b, "%s: %d occurrence(s) replaced\n", color.Yel5(path), occ)
+		return b.String(), nil
+	}
+	if s.json {
+		return s.jsonMatches(path, data)
+	}
+
+	lines := splitLines(data)
+	hunks := buildHunks(data, s.re, s.to)
+	shown := 0 // lines before this one have been printed
+	for i, h := range hunks {
+		first := max(h.start-s.before, shown)
+		if i > 0 && first > shown && s.before+s.after > 0 {
+			b.WriteString(color.Cya5("--") + "\n")
+		}
+		for n := first; n < h.start; n++ {
+			fmt.Fprintf(&b, "%s-%d- %s\n", color.Yel5(path), n+1, lines[n])
+		}
+		s.writeHunk(&b, path, data, h)
+		last := min(h.end+s.after, len(lines))
+		if i+1 < len(hunks) {
+			last = min(last, hunks[i+1].start)
+		}
+		for n := h.end; n < last; n++ {
+			fmt.Fprintf(&b, "%s-%d- %s\n", color.Yel5(path), n+1, lines[n])
+		}
+		shown = max(h.end, last)
+	}
+	return b.String(), nil
+}
+
+// writeHunk prints the lines of one hunk: the matching lines in searchMode,
+// or the lines before (-) and after (+) replacement in showMode. Each line
+// carries its line number, or in multiline mode the hunk is labeled once
+// with its line range.
+func (s *scanner) writeHunk(b *strings.Builder, path string, data []byte, h hunk) {
+	old, new := markHunk(data, h, s.re, s.to)
+	var rows []string // rendered lines
+	var nums []int    // their line numbers
+	if s.mode == searchMode {
+		for i, l := range old {
+			rows, nums = append(rows, l), append(nums, h.start+i+1)
+		}
+	} else {
+		for i, l := range old {
+			rows, nums = append(rows, color.Red5("-")+" "+l), append(nums, h.start+i+1)
+		}
+		for i, l := range new {
+			rows, nums = append(rows, color.Grn5("+")+" "+l), append(nums, h.start+i+1)
+		}
+	}
+
+	if !s.multiline {
+		for i, r := range rows {
+			fmt.Fprintf(b, "%s:%d: %s\n", color.Yel5(path), nums[i], r)
+		}
+		return
+	}
+	label := fmt.Sprintf(":%d:", h.start+1)
+	if h.end-h.start > 1 {
+		label = fmt.Sprintf(":%d-%d:", h.start+1, h.end)
+	}
+	indent := strings.Repeat(" ", len(path)+len(label))
+	for i, r := range rows {
+		if i == 0 {
+			fmt.Fprintf(b, "%s%s %s\n", color.Yel5(path), label, r)
+		} else {
+			fmt.Fprintf(b, "%s %s\n", indent, r)
+		}
+	}
+}
+
+// matchRecord is the --json record of one match in the search and
+// show-only modes. Line and Column are 1-based; Column counts bytes.
+type matchRecord struct {
+	Path        string  `json:"path"`
+	Line        int     `json:"line"`
+	Column      int     `json:"column"`
+	EndLine     int     `json:"end_line"`
+	Match       string  `json:"match"`
+	Replacement *string `json:"replacement,omitempty"` // show-only mode
+}
+
+// replaceRecord is the --json record of one file written in replaceMode.
+type replaceRecord struct {
+	Path         string `json:"path"`
+	Replacements int    `json:"replacements"`
+}
+
+// jsonLine encodes v as one line of JSON.
+func jsonLine(v any) (string, error) {
+	var b strings.Builder
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// jsonMatches returns a matchRecord line for every match in data.
+func (s *scanner) jsonMatches(path string, data []byte) (string, error) {
+	li := newLineIndex(data)
+	var b strings.Builder
+	for _, loc := range s.re.FindAllSubmatchIndex(data, -1) {
+		first, last := li.matchLines(loc)
+		rec := matchRecord{
+			Path:    path,
+			Line:    first + 1,
+			Column:  loc[0] - li[first] + 1,
+			EndLine: last + 1,
+			Match:   string(data[loc[0]:loc[1]]),
+		}
+		if s.mode == showMode {
+			repl := string(s.re.Expand(nil, []byte(s.to), data, loc))
+			rec.Replacement = &repl
+		}
+		line, err := jsonLine(rec)
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(line)
+	}
+	return b.String(), nil
+}
+
+// scanFiles runs scan over paths on a pool of workers and writes each
+// file's output to w in the order of paths, as soon as that file and every
+// file before it are done. Failures are reported on errw and do not stop
+// the other files; the returned error counts them.
+func scanFiles(paths []string, workers int, scan func(string) (string, error), w, errw io.Writer) error {
+	type result struct {
+		out string
+		err error
+	}
+	results := make([]chan result, len(paths))
+	for i := range results {
+		results[i] = make(chan result, 1)
+	}
+	next := make(chan int)
+	go func() {
+		for i := range paths {
+			next <- i
+		}
+		close(next)
+	}()
+	for range max(workers, 1) {
+		go func() {
+			for i := range next {
+				out, err := scan(paths[i])
+				results[i] <- result{out, err}
+			}
+		}()
+	}
+
+	failed := 0
+	for i, ch := range results {
+		r := <-ch
+		if r.err != nil {
+			failed++
+			fmt.Fprintf(errw, "%s: %s: %v\n", programName, paths[i], r.err)
+			continue
+		}
+		io.WriteString(w, r.out)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d file(s) could not be processed", failed)
+	}
+	return nil
+}
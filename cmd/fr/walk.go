@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/queone/utils/internal/ignore"
+)
+
+// ignoreFiles are read in every directory of the walk, in this order, so
+// .ignore rules can override .gitignore ones.
+var ignoreFiles = []string{".gitignore", ".ignore"}
+
+// filter decides which paths of the walk are examined.
+type filter struct {
+	noIgnore bool
+	include  *ignore.Matcher // nil examines every file
+	exclude  *ignore.Matcher // nil skips nothing
+}
+
+// newFilter compiles the --include and --exclude globs.
+func newFilter(opts options) (filter, error) {
+	f := filter{noIgnore: opts.noIgnore}
+	for _, g := range []struct {
+		flag     string
+		patterns []string
+		m        **ignore.Matcher
+	}{
+		{"--include", opts.include, &f.include},
+		{"--exclude", opts.exclude, &f.exclude},
+	} {
+		if len(g.patterns) == 0 {
+			continue
+		}
+		m := ignore.New()
+		for _, p := range g.patterns {
+			if strings.HasPrefix(p, "!") {
+				return f, fmt.Errorf("%s %q: negated globs are not supported", g.flag, p)
+			}
+			if err := m.Add("", []string{p}); err != nil {
+				return f, fmt.Errorf("%s %q: %w", g.flag, p, err)
+			}
+		}
+		*g.m = m
+	}
+	return f, nil
+}
+
+// ancestorIgnores returns the rules of the ignore files in the directories
+// above root, up to the top of the git work tree holding it, with bases
+// relative to that top, and root's own path relative to it. Outside a work
+// tree, or at its top, there are no such rules and the path is "".
+func ancestorIgnores(root string) (*ignore.Matcher, string, error) {
+	ign := ignore.New()
+	abs, err := filepath.Abs(root)
+	if err != nil {
+		return nil, "", err
+	}
+	top := abs
+	for {
+		if _, err := os.Lstat(filepath.Join(top, ".git")); err == nil {
+			break
+		}
+		parent := filepath.Dir(top)
+		if parent == top {
+			return ign, "", nil
+		}
+		top = parent
+	}
+	rel, err := filepath.Rel(top, abs)
+	if err != nil || rel == "." {
+		return ign, "", err
+	}
+	prefix := filepath.ToSlash(rel)
+	base := ""
+	for part := range strings.SplitSeq(prefix, "/") {
+		for _, name := range ignoreFiles {
+			if err := ign.AddFile(base, filepath.Join(top, filepath.FromSlash(base), name)); err != nil {
+				return nil, "", err
+			}
+		}
+		base = path.Join(base, part)
+	}
+	return ign, prefix, nil
+}
+
+// collectFiles returns the regular files and the directories under root in
+// lexical order, root itself excluded. It skips hidden directories, paths
+// ignored by .gitignore and .ignore files (unless f.noIgnore is set), paths
+// matching f.exclude, and files not matching f.include. Globs see paths
+// relative to root. Ignore files are read from root down and, when root
+// lies below the top of a git work tree, from the directories above it too,
+// so walking a subdirectory skips what walking from the top would.
+func collectFiles(root string, f filter) (paths, dirs []string, err error) {
+	ign, prefix := ignore.New(), ""
+	if !f.noIgnore {
+		if ign, prefix, err = ancestorIgnores(root); err != nil {
+			return nil, nil, err
+		}
+	}
+	err = filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		top := path.Join(prefix, rel) // what the ignore rules see
+
+		if d.IsDir() {
+			switch {
+			case rel == ".":
+				rel = ""
+			case strings.HasPrefix(d.Name(), ".") || ign.Match(top, true) ||
+				(f.exclude != nil && f.exclude.Match(rel, true)):
+				return filepath.SkipDir
+			default:
+				dirs = append(dirs, p)
+			}
+			if !f.noIgnore {
+				for _, name := range ignoreFiles {
+					if err := ign.AddFile(top, filepath.Join(p, name)); err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		}
+
+		if !d.Type().IsRegular() || ign.Match(top, false) {
+			return nil
+		}
+		if f.exclude != nil && f.exclude.Match(rel, false) {
+			return nil
+		}
+		if f.include != nil && !f.include.Match(rel, false) {
+			return nil
+		}
+		paths = append(paths, p)
+		return nil
+	})
+	return paths, dirs, err
+}
+
+// gatherFiles returns the files and directories a run examines: those
+// under opts.root, or the files listed after -- or on stdin. Listed
+// directories are walked with collectFiles; listed files are taken as
+// they are, whatever the ignore rules and globs say.
+func gatherFiles(opts options, f filter, stdin io.Reader) (paths, dirs []string, err error) {
+	list := opts.files
+	if opts.stdin {
+		data, err := io.ReadAll(stdin)
+		if err != nil {
+			return nil, nil, fmt.Errorf("reading the file list: %w", err)
+		}
+		sep := []byte("\n")
+		if opts.null {
+			sep = []byte{0}
+		}
+		for _, name := range bytes.Split(data, sep) {
+			if !opts.null {
+				name = bytes.TrimSuffix(name, []byte("\r"))
+			}
+			if len(name) > 0 {
+				list = append(list, string(name))
+			}
+		}
+	}
+	if len(list) == 0 && !opts.stdin {
+		list = []string{opts.root}
+	}
+
+	seen := map[string]bool{} // a file listed twice must not be replaced twice
+	add := func(p string) {
+		if clean := filepath.Clean(p); !seen[clean] {
+			seen[clean] = true
+			paths = append(paths, p)
+		}
+	}
+	for _, name := range list {
+		if info, err := os.Stat(name); err != nil || !info.IsDir() {
+			add(name) // a missing file is reported when it is read
+			continue
+		}
+		p, d, err := collectFiles(name, f)
+		if err != nil {
+			return nil, nil, fmt.Errorf("walk error: %w", err)
+		}
+		for _, path := range p {
+			add(path)
+		}
+		dirs = append(dirs, d...)
+	}
+	return paths, dirs, nil
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func writeTree(t *testing.T, root string, files map[string]string) {
+	t.Helper()
+	for rel, content := range files {
+		p := filepath.Join(root, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func relPaths(t *testing.T, root string, paths []string) []string {
+	t.Helper()
+	var out []string
+	for _, p := range paths {
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out = append(out, filepath.ToSlash(rel))
+	}
+	return out
+}
+
+func TestCollectFiles(t *testing.T) {
+	root := t.TempDir()
+	writeTree(t, root, map[string]string{
+		".gitignore":          "build/\n*.log\n",
+		"main.go":             "",
+		"app.log":             "",
+		"build/out.go":        "",
+		".git/config":         "",
+		"pkg/.ignore":         "gen_*.go\n!gen_keep.go\n",
+		"pkg/a.go":            "",
+		"pkg/gen_x.go":        "",
+		"pkg/gen_keep.go":     "",
+		"pkg/testdata/t.go":   "",
+		"pkg/notes.txt":       "",
+		"vendor/lib/lib.go":   "",
+		"vendor/lib/.ignore":  "*.go\n",
+		"docs/guide/index.md": "",
+	})
+
+	cases := []struct {
+		name string
+		opts options
+		want []string
+	}{
+		{
+			name: "ignore files",
+			want: []string{".gitignore", "docs/guide/index.md", "main.go", "pkg/.ignore", "pkg/a.go", "pkg/gen_keep.go", "pkg/notes.txt", "pkg/testdata/t.go", "vendor/lib/.ignore"},
+		},
+		{
+			name: "no ignore",
+			opts: options{noIgnore: true},
+			want: []string{".gitignore", "app.log", "build/out.go", "docs/guide/index.md", "main.go", "pkg/.ignore", "pkg/a.go", "pkg/gen_keep.go", "pkg/gen_x.go", "pkg/notes.txt", "pkg/testdata/t.go", "vendor/lib/.ignore", "vendor/lib/lib.go"},
+		},
+		{
+			name: "include and exclude",
+			opts: options{include: []string{"*.go"}, exclude: []string{"pkg/testdata/**", "gen_keep.go"}},
+			want: []string{"main.go", "pkg/a.go"},
+		},
+		{
+			name: "exclude directory",
+			opts: options{exclude: []string{"pkg/", "docs"}},
+			want: []string{".gitignore", "main.go", "vendor/lib/.ignore"},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			f, err := newFilter(tc.opts)
+			if err != nil {
+				t.Fatalf("newFilter: %v", err)
+			}
+			paths, _, err := collectFiles(root, f)
+			if err != nil {
+				t.Fatalf("collectFiles: %v", err)
+			}
+			if got := relPaths(t, root, paths); !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("collectFiles =\n  %v\nwant\n  %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestCollectFilesReadsAncestorIgnores(t *testing.T) {
+	top := t.TempDir()
+	writeTree(t, top, map[string]string{
+		".git/HEAD":           "",
+		".gitignore":          "*.log\nbuild/\n/src/gen.go\n",
+		"src/.gitignore":      "!keep.log\n",
+		"src/main.go":         "",
+		"src/app.log":         "",
+		"src/keep.log":        "",
+		"src/gen.go":          "",
+		"src/build/out.go":    "",
+		"src/pkg/gen.go":      "",
+		"src/pkg/x/debug.log": "",
+	})
+	paths, _, err := collectFiles(filepath.Join(top, "src"), filter{})
+	if err != nil {
+		t.Fatalf("collectFiles: %v", err)
+	}
+	want := []string{".gitignore", "keep.log", "main.go", "pkg/gen.go"}
+	if got := relPaths(t, filepath.Join(top, "src"), paths); !reflect.DeepEqual(got, want) {
+		t.Fatalf("collectFiles =\n  %v\nwant\n  %v", got, want)
+	}
+}
+
+func TestNewFilterRejectsNegation(t *testing.T) {
+	if _, err := newFilter(options{include: []string{"!*.go"}}); err == nil {
+		t.Fatal("newFilter accepted a negated --include")
+	}
+}
+
+func TestParseArgs(t *testing.T) {
+	opts, err := parseArgs([]string{"--include", "*.go", "old", "-f", "new", "--path=src", "--exclude=vendor/**", "--no-ignore"})
+	if err != nil {
+		t.Fatalf("parseArgs: %v", err)
+	}
+	want := options{from: "old", to: "new", hasTo: true, force: true, root: "src", noIgnore: true,
+		include: []string{"*.go"}, exclude: []string{"vendor/**"}}
+	if !reflect.DeepEqual(opts, want) {
+		t.Fatalf("parseArgs = %+v, want %+v", opts, want)
+	}
+
+	opts, err = parseArgs([]string{"old", ""})
+	if err != nil || !opts.hasTo || opts.to != "" || opts.root != "." {
+		t.Fatalf("parseArgs with empty TO = %+v, %v", opts, err)
+	}
+
+	opts, err = parseArgs([]string{"-U", "-C", "2", "-A=4", "x"})
+	if err != nil || !opts.multiline || opts.before != 2 || opts.after != 4 {
+		t.Fatalf("parseArgs with context = %+v, %v", opts, err)
+	}
+
+	for _, args := range [][]string{
+		{},
+		{"a", "-A"},
+		{"a", "-B", "-1"},
+		{"a", "b", "-C", "2", "-f"},
+		{"a", "b", "--json", "-i"},
+		{"--undo", "--json"},
+		{"a", "--names"},
+		{"a", "b", "--names", "-i"},
+		{"a", "b", "-i", "--stdin"},
+		{"a", "-0", "--", "f"},
+		{"a", "--path", "src", "--", "f"},
+		{"--undo", "--", "f"},
+		{"a", "b", "c"},
+		{"a", "-f"},
+		{"a", "b", "--path"},
+		{"a", "--bogus"},
+	} {
+		if _, err := parseArgs(args); err == nil {
+			t.Errorf("parseArgs(%q) succeeded, want error", args)
+		}
+	}
+}
+
+func TestGatherFiles(t *testing.T) {
+	root := t.TempDir()
+	writeTree(t, root, map[string]string{
+		".gitignore":   "*.log\n",
+		"a.txt":        "",
+		"app.log":      "",
+		"dir/b.txt":    "",
+		"dir/skip.log": "",
+	})
+	t.Chdir(root)
+
+	cases := []struct {
+		name  string
+		opts  options
+		stdin string
+		want  []string
+	}{
+		{name: "walk", opts: options{root: "."}, want: []string{".gitignore", "a.txt", "dir/b.txt"}},
+		{name: "listed", opts: options{root: ".", files: []string{"app.log", "dir", "a.txt", "./app.log"}}, want: []string{"app.log", "dir/b.txt", "dir/skip.log", "a.txt"}},
+		{name: "stdin lines", opts: options{root: ".", stdin: true}, stdin: "a.txt\r\n\napp.log\n", want: []string{"a.txt", "app.log"}},
+		{name: "stdin nul", opts: options{root: ".", stdin: true, null: true}, stdin: "a b\x00a.txt\x00", want: []string{"a b", "a.txt"}},
+		{name: "empty stdin", opts: options{root: ".", stdin: true}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			f, err := newFilter(tc.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			paths, _, err := gatherFiles(tc.opts, f, strings.NewReader(tc.stdin))
+			if err != nil {
+				t.Fatalf("gatherFiles: %v", err)
+			}
+			if got := relPaths(t, ".", paths); !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("gatherFiles = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestFRReadsFileListFromStdin(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{"a.txt": "old\n", "b.txt": "old\n"})
+	if out, err := runFRInput(t, dir, "b.txt\x00", "-0", "old", "new", "-f"); err != nil {
+		t.Fatalf("fr -0: %v\n%s", err, out)
+	}
+	assertFile(t, filepath.Join(dir, "a.txt"), "old\n")
+	assertFile(t, filepath.Join(dir, "b.txt"), "new\n")
+}
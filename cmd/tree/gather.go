@@ -0,0 +1,223 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// node is one file or directory of the gathered tree.
+type node struct {
+	name     string
+	path     string
+	info     fs.FileInfo // from Lstat
+	size     int64       // file size, or with --du the total under a directory
+	git      string      // status code with --git, see gitStatus.code
+	children []*node     // directories only, already filtered and sorted
+	err      error       // reading the directory failed
+	link     string      // target of a symlink
+	broken   bool        // the symlink's target does not exist
+	linkDir  fs.FileInfo // with -l, the directory a symlink points to
+	loop     bool        // a followed directory that is also one of its ancestors
+}
+
+// isDir reports whether n is a directory, or with -l a symlink to one.
+func (n *node) isDir() bool { return n.info.IsDir() || n.linkDir != nil }
+
+// dirInfo returns the file info of the directory n lists.
+func (n *node) dirInfo() fs.FileInfo {
+	if n.linkDir != nil {
+		return n.linkDir
+	}
+	return n.info
+}
+
+// enter reports whether the directory n may be listed below ancestors, the
+// directories on its path, and returns the ancestors of its children.
+// Only followed symlinks can lead back to an ancestor, so a repeated
+// directory marks n as a loop instead.
+func (n *node) enter(ancestors []fs.FileInfo, opts options) ([]fs.FileInfo, bool) {
+	info := n.dirInfo()
+	if opts.follow && slices.ContainsFunc(ancestors, func(a fs.FileInfo) bool { return os.SameFile(a, info) }) {
+		n.loop = true
+		return nil, false
+	}
+	return append(slices.Clip(ancestors), info), true
+}
+
+// sortKeys are the accepted --sort values.
+var sortKeys = []string{"name", "size", "mtime", "ext"}
+
+// matchAny reports whether name matches one of patterns. Each pattern is a
+// filepath.Match wildcard, and may hold several alternatives separated by
+// |, as in "*.go|*.mod".
+func matchAny(patterns []string, name string) bool {
+	for _, p := range patterns {
+		for alt := range strings.SplitSeq(p, "|") {
+			if ok, _ := filepath.Match(alt, name); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// gather reads the tree under dir down to opts.level and returns its root,
+// whose children are filtered and sorted.
+func gather(dir string, opts options) (*node, error) {
+	root, err := rootNode(dir)
+	if err != nil {
+		return nil, err
+	}
+	var total int64
+	root.children, total, root.err = gatherDir(dir, 1, []fs.FileInfo{root.info}, opts)
+	if root.err != nil && root.children == nil {
+		return nil, root.err
+	}
+	if opts.du {
+		root.size = total
+	}
+	return root, nil
+}
+
+// rootNode returns the node of dir, which must be a directory.
+func rootNode(dir string) (*node, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", dir)
+	}
+	return &node{name: dir, path: dir, info: info, size: info.Size()}, nil
+}
+
+// listDir returns the entries of dir to list, without descending: hidden,
+// excluded and git-ignored entries are dropped, and so are the files -d and
+// -P leave out. skipped is the size of what was dropped, directories
+// included, when opts.du needs it. Entries read before an error are kept.
+func listDir(dir string, opts options) (nodes []*node, skipped int64, err error) {
+	entries, err := os.ReadDir(dir)
+	for _, e := range entries {
+		name := e.Name()
+		p := filepath.Join(dir, name)
+		info, lerr := os.Lstat(p)
+		if lerr != nil {
+			continue
+		}
+		n := &node{name: name, path: p, info: info, size: info.Size()}
+		if info.Mode()&fs.ModeSymlink != 0 {
+			n.link, _ = os.Readlink(p)
+			if target, err := os.Stat(p); err != nil {
+				n.broken = true
+			} else if opts.follow && target.IsDir() {
+				n.linkDir = target
+			}
+		}
+		if opts.status != nil {
+			n.git = opts.status.code(p, n.isDir())
+		}
+		drop := !opts.all && strings.HasPrefix(name, ".") || matchAny(opts.exclude, name) ||
+			opts.hideIgnored && n.git == "!!" ||
+			!n.isDir() && (opts.dirsOnly || len(opts.include) > 0 && !matchAny(opts.include, name))
+		if !drop {
+			nodes = append(nodes, n)
+		} else if opts.du && n.isDir() {
+			skipped += diskUsage(p)
+		} else if opts.du {
+			skipped += n.size
+		}
+	}
+	return nodes, skipped, err
+}
+
+// gatherDir returns the listed children of dir, read down to opts.level,
+// and with --du the total size of everything under dir, listed or not.
+// Directories that cannot be read keep the error in their node.
+func gatherDir(dir string, depth int, ancestors []fs.FileInfo, opts options) ([]*node, int64, error) {
+	nodes, total, err := listDir(dir, opts)
+	kept := nodes[:0]
+	for _, n := range nodes {
+		if n.isDir() {
+			switch {
+			case opts.level == 0 || depth < opts.level:
+				if below, ok := n.enter(ancestors, opts); ok {
+					var size int64
+					n.children, size, n.err = gatherDir(n.path, depth+1, below, opts)
+					if opts.du {
+						n.size = size
+					}
+				}
+			case opts.du:
+				n.size = diskUsage(n.path)
+			}
+		}
+		total += n.size
+		// With -P a directory stays only to connect matching entries
+		// below it, or with -d when its own name matches.
+		if n.isDir() && len(opts.include) > 0 && len(n.children) == 0 && n.err == nil &&
+			!(opts.dirsOnly && matchAny(opts.include, n.name)) {
+			continue
+		}
+		kept = append(kept, n)
+	}
+	sortNodes(kept, opts.sort, !opts.du)
+	return kept, total, err
+}
+
+// unreadable counts the directories under n that could not be read.
+func unreadable(n *node) int {
+	count := 0
+	for _, c := range n.children {
+		count += unreadable(c)
+	}
+	if n.err != nil {
+		count++
+	}
+	return count
+}
+
+// diskUsage returns the total size of the files under dir.
+func diskUsage(dir string) int64 {
+	var total int64
+	filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			if info, err := d.Info(); err == nil {
+				total += info.Size()
+			}
+		}
+		return nil
+	})
+	return total
+}
+
+// sortNodes orders nodes by key, directories first when dirsFirst is set.
+// An empty key keeps the name order os.ReadDir returns, directories mixed
+// with files.
+func sortNodes(nodes []*node, key string, dirsFirst bool) {
+	if key == "" {
+		return
+	}
+	less := func(a, b *node) bool { return a.name < b.name }
+	switch key {
+	case "size":
+		less = func(a, b *node) bool { return a.size > b.size }
+	case "mtime":
+		less = func(a, b *node) bool { return a.info.ModTime().After(b.info.ModTime()) }
+	case "ext":
+		less = func(a, b *node) bool {
+			return strings.ToLower(filepath.Ext(a.name)) < strings.ToLower(filepath.Ext(b.name))
+		}
+	}
+	sort.SliceStable(nodes, func(i, j int) bool {
+		a, b := nodes[i], nodes[j]
+		if dirsFirst && a.isDir() != b.isDir() {
+			return a.isDir()
+		}
+		return less(a, b)
+	})
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// gitStatus is the porcelain status of a work tree, keyed by paths
+// relative to its top.
+type gitStatus struct {
+	root    string            // the directory tree lists
+	prefix  string            // root relative to the work tree top, "" at the top
+	codes   map[string]string // XY status of changed, untracked and ignored files
+	ignored map[string]bool   // directories ignored as a whole
+	dirty   map[string]bool   // directories with a changed or untracked file below
+}
+
+// loadGitStatus runs git status for the work tree holding dir.
+func loadGitStatus(dir string) (*gitStatus, error) {
+	out, err := exec.Command("git", "-C", dir, "rev-parse", "--show-prefix").Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s is not inside a git work tree", dir)
+	}
+	g := &gitStatus{
+		root:    dir,
+		prefix:  strings.TrimSuffix(strings.TrimSpace(string(out)), "/"),
+		codes:   map[string]string{},
+		ignored: map[string]bool{},
+		dirty:   map[string]bool{},
+	}
+	out, err = exec.Command("git", "-C", dir, "status", "--porcelain=v1", "-z",
+		"--untracked-files=all", "--ignored=matching", ".").Output()
+	if err != nil {
+		return nil, fmt.Errorf("git status: %w", err)
+	}
+	records := bytes.Split(out, []byte{0})
+	for i := 0; i < len(records); i++ {
+		rec := string(records[i])
+		if len(rec) < 4 {
+			continue
+		}
+		code, p := rec[:2], rec[3:]
+		if code[0] == 'R' || code[0] == 'C' {
+			i++ // the next record is the original path
+		}
+		if code == "!!" {
+			if strings.HasSuffix(p, "/") {
+				g.ignored[strings.TrimSuffix(p, "/")] = true
+			} else {
+				g.codes[p] = code
+			}
+			continue
+		}
+		g.codes[strings.TrimSuffix(p, "/")] = code
+		for d := path.Dir(p); d != "."; d = path.Dir(d) {
+			g.dirty[d] = true
+		}
+	}
+	return g, nil
+}
+
+// rel returns p, a path under g.root, relative to the work tree top.
+func (g *gitStatus) rel(p string) string {
+	r, err := filepath.Rel(g.root, p)
+	if err != nil {
+		return p
+	}
+	return path.Join(g.prefix, filepath.ToSlash(r))
+}
+
+// code returns the status shown for the entry at p: the XY code of a
+// file, "!!" for anything ignored, "*" for a directory holding changes,
+// and "" for a clean entry.
+func (g *gitStatus) code(p string, isDir bool) string {
+	rel := g.rel(p)
+	if c, ok := g.codes[rel]; ok {
+		return c
+	}
+	for d := rel; d != "." && d != "/" && d != ""; d = path.Dir(d) {
+		if g.ignored[d] {
+			return "!!"
+		}
+	}
+	if isDir && g.dirty[rel] {
+		return "*"
+	}
+	return ""
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	fzf "github.com/koki-develop/go-fzf"
+	"github.com/queone/utils/internal/bytesize"
+)
+
+// previewBytes is how much of a file the preview pane reads.
+const previewBytes = 64 * 1024
+
+// itemText is how the finder lists n: its path below root, with a trailing
+// slash for directories.
+func itemText(root string, n *node) string {
+	rel, err := filepath.Rel(root, n.path)
+	if err != nil {
+		rel = n.path
+	}
+	if n.isDir() {
+		rel += string(filepath.Separator)
+	}
+	return rel
+}
+
+// firstLines returns at most n lines of s.
+func firstLines(s string, n int) string {
+	lines := strings.SplitAfter(s, "\n")
+	if len(lines) > n {
+		lines = lines[:n]
+	}
+	return strings.Join(lines, "")
+}
+
+// preview returns what the preview pane shows for n, at most height
+// lines: the subtree of a directory or the start of a file.
+func preview(n *node, opts options, height int) string {
+	switch {
+	case n.broken:
+		return "broken link to " + n.link
+	case n.err != nil:
+		return "cannot read: " + readError(n)
+	case n.isDir():
+		var b strings.Builder
+		p := &printer{w: &b, opts: opts}
+		p.printLines(flatten(n.children, "", nil))
+		return firstLines(b.String(), height)
+	}
+	f, err := os.Open(n.path)
+	if err != nil {
+		return err.Error()
+	}
+	defer f.Close()
+	head := make([]byte, previewBytes)
+	k, err := io.ReadFull(f, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err.Error()
+	}
+	head = head[:k]
+	if bytes.IndexByte(head, 0) >= 0 {
+		return fmt.Sprintf("binary file, %s", bytesize.Format(n.size))
+	}
+	return firstLines(string(head), height)
+}
+
+// navigate opens the gathered tree in a fuzzy finder, drawn on stderr, and
+// writes the path of the chosen entry to w.
+func navigate(w io.Writer, root *node, opts options) error {
+	lines := flatten(root.children, "", nil)
+	if len(lines) == 0 {
+		return fmt.Errorf("%s has no entries to choose from", root.path)
+	}
+	f, err := fzf.New(fzf.WithInputPlaceholder("Filter..."))
+	if err != nil {
+		return err
+	}
+	idx, err := f.Find(lines,
+		func(i int) string { return itemText(root.path, lines[i].node) },
+		fzf.WithPreviewWindow(func(i, width, height int) string {
+			return preview(lines[i].node, opts, height)
+		}),
+	)
+	if errors.Is(err, fzf.ErrAbort) {
+		return errors.New("nothing selected")
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(w, lines[idx[0]].node.path)
+	return nil
+}
@@ -2,20 +2,23 @@ package main
 
 import (
 	"fmt"
+	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
-	"unicode/utf8"
 
 	"github.com/queone/governa-color"
 )
 
 const (
 	programName    = "tree"
-	programVersion = "1.0.3"
+	programVersion = "1.7.0"
 )
 
-func printUsage() {
+func printUsage(w io.Writer) {
 	n := color.Whi10(programName)
 	v := programVersion
 	usage := fmt.Sprintf("%s v%s\n"+
@@ -28,131 +31,228 @@ func printUsage() {
 		"\n"+
 		"%s\n"+
 		"  -f                Show full file paths. Can be placed before or after the dir path.\n"+
+		"  -a                Show hidden files and directories\n"+
+		"  -d                List directories only\n"+
+		"  -l                Follow symlinks to directories, skipping any that loop back\n"+
+		"  -L N              Descend at most N levels\n"+
+		"  -P PATTERN        List only files matching PATTERN, and the directories leading to them\n"+
+		"  -I PATTERN        Leave out files and directories matching PATTERN\n"+
+		"  --sort KEY        Sort by name, size (largest first), mtime (newest first) or ext,\n"+
+		"                    directories first\n"+
+		"  -p                Show permission bits\n"+
+		"  -s                Show human-readable sizes\n"+
+		"  -D                Show modification times\n"+
+		"  --du              Give each directory the total size under it and sort by size; implies -s\n"+
+		"  --git             Show the git status of each file; * marks directories with changes\n"+
+		"  --hide-ignored    Leave out files and directories ignored by git\n"+
+		"  --stream          Print while walking, for huge trees: columns align per directory,\n"+
+		"                    and -P keeps directories without matches\n"+
+		"  -i                Pick an entry in a fuzzy finder with a preview pane and print its path\n"+
+		"  -o FORMAT         Output as text (default), json, yaml, md (nested list) or html\n"+
+		"                    (collapsible page)\n"+
 		"  -v, --version     Print version and exit\n"+
 		"  -?, --help, -h    Show this help message and exit\n"+
 		"\n"+
+		"  PATTERN is a wildcard matched against names, such as '*.go'; separate\n"+
+		"  alternatives with | and repeat -P or -I to add more.\n"+
+		"\n"+
 		"%s\n"+
 		"  %s\n"+
 		"  %s -f /path/to/directory\n"+
 		"  %s /path/to/directory -f\n"+
+		"  %s -L 2 -d\n"+
+		"  %s -P '*.go|*.mod' -I vendor --sort ext\n"+
+		"  %s --du -d -L 2\n"+
+		"  %s -o json -L 3 > layout.json\n"+
+		"  %s --git --hide-ignored\n"+
+		"  %s --stream /\n"+
+		"  cd \"$(%s -i -d)\"\n"+
 		"  %s -h\n",
-		n, v, color.Whi10("Usage"), n, color.Whi10("Options"), color.Whi10("Examples"), n, n, n, n)
-	fmt.Print(usage)
-	os.Exit(0)
+		n, v, color.Whi10("Usage"), n, color.Whi10("Options"), color.Whi10("Examples"), n, n, n, n, n, n, n, n, n, n, n)
+	fmt.Fprint(w, usage)
 }
 
-// printTree performs a total of three passes:
-// 1) Gather pass: Recursively walks the directory to build a list of entries.
-// 2) Determine maximum length: Calculates the longest line (for alignment).
-// 3) Print pass: Uses the maximum length to align and print the tree.
-func printTree(dir string, showFullPath bool) {
-	// entry holds information about each file or directory.
-	type entry struct {
-		prefix     string // Visual prefix for tree structure
-		isLast     bool   // Whether this is the last entry in its level
-		name       string // Filename or directory name
-		fullPath   string // Absolute path
-		isDir      bool   // True if directory
-		runeLength int    // Calculated length for alignment
-	}
+// options holds the parsed command line.
+type options struct {
+	dir         string
+	fullPath    bool
+	all         bool     // show hidden entries
+	dirsOnly    bool     // leave out files
+	follow      bool     // descend into symlinked directories
+	level       int      // deepest level listed; 0 is unlimited
+	sort        string   // one of sortKeys, or "" for directory order
+	include     []string // -P patterns
+	exclude     []string // -I patterns
+	perms       bool     // show the permission column
+	size        bool     // show the size column
+	mtime       bool     // show the modification time column
+	du          bool     // total the sizes of directories
+	format      string   // one of formats
+	git         bool     // show the git status column
+	hideIgnored bool     // leave out entries git ignores
+	stream      bool     // print while walking
+	interact    bool     // pick an entry in the fuzzy finder
 
-	var all []entry
+	status *gitStatus // loaded by run for --git and --hide-ignored
+}
 
-	// gather recursively walks directories, building a list of entries.
-	var gather func(string, string)
-	gather = func(curDir, curPrefix string) {
-		files, _ := os.ReadDir(curDir)
-		var filtered []os.DirEntry
-		for _, f := range files {
-			if f.Name() != "." && f.Name() != ".." {
-				filtered = append(filtered, f)
-			}
-		}
-		for i, f := range filtered {
-			isLast := i == len(filtered)-1
-			mark := "├── "
-			if isLast {
-				mark = "└── "
+// parseArgs reads the flags and the directory. Flags may appear anywhere;
+// value flags accept "-L N" or "-L=N".
+func parseArgs(args []string) (options, error) {
+	opts := options{dir: ".", format: "text"}
+	for i := 0; i < len(args); i++ {
+		a := args[i]
+		name, value, hasValue := strings.Cut(a, "=")
+		switch {
+		case a == "-f":
+			opts.fullPath = true
+		case a == "-a":
+			opts.all = true
+		case a == "-d":
+			opts.dirsOnly = true
+		case a == "-l":
+			opts.follow = true
+		case a == "-p":
+			opts.perms = true
+		case a == "-s":
+			opts.size = true
+		case a == "-D":
+			opts.mtime = true
+		case a == "--git":
+			opts.git = true
+		case a == "--hide-ignored":
+			opts.hideIgnored = true
+		case a == "--stream":
+			opts.stream = true
+		case a == "-i":
+			opts.interact = true
+		case a == "--du":
+			opts.du, opts.size = true, true
+		case name == "-L" || name == "-P" || name == "-I" || name == "--sort" || name == "-o":
+			if !hasValue {
+				if i+1 >= len(args) {
+					return opts, fmt.Errorf("%s requires a value (see %s --help)", name, programName)
+				}
+				i++
+				value = args[i]
 			}
-			rawLine := curPrefix + mark + f.Name()
-			all = append(all, entry{
-				prefix:     curPrefix,
-				isLast:     isLast,
-				name:       f.Name(),
-				fullPath:   filepath.Join(curDir, f.Name()),
-				isDir:      f.IsDir(),
-				runeLength: utf8.RuneCountInString(rawLine),
-			})
-
-			if f.IsDir() {
-				nextPrefix := curPrefix + "│   "
-				if isLast {
-					nextPrefix = curPrefix + "    "
+			switch name {
+			case "-L":
+				n, err := strconv.Atoi(value)
+				if err != nil || n < 1 {
+					return opts, fmt.Errorf("-L: invalid level %q; use a positive integer", value)
+				}
+				opts.level = n
+			case "-o":
+				if !slices.Contains(formats, value) {
+					return opts, fmt.Errorf("-o: unknown format %q; use one of %s", value, strings.Join(formats, ", "))
+				}
+				opts.format = value
+			case "--sort":
+				if !slices.Contains(sortKeys, value) {
+					return opts, fmt.Errorf("--sort: unknown key %q; use one of %s", value, strings.Join(sortKeys, ", "))
+				}
+				opts.sort = value
+			default:
+				for alt := range strings.SplitSeq(value, "|") {
+					if _, err := filepath.Match(alt, ""); err != nil {
+						return opts, fmt.Errorf("%s: invalid pattern %q", name, value)
+					}
+				}
+				if name == "-P" {
+					opts.include = append(opts.include, value)
+				} else {
+					opts.exclude = append(opts.exclude, value)
 				}
-				gather(filepath.Join(curDir, f.Name()), nextPrefix)
 			}
+		case strings.HasPrefix(a, "-") && len(a) > 1:
+			return opts, fmt.Errorf("unknown flag %q (see %s --help)", a, programName)
+		default:
+			opts.dir = a
 		}
 	}
+	if opts.stream && (opts.du || opts.format != "text") {
+		return opts, fmt.Errorf("--stream cannot be combined with --du or -o; both need the whole tree first")
+	}
+	if opts.interact && (opts.stream || opts.format != "text") {
+		return opts, fmt.Errorf("-i cannot be combined with --stream or -o")
+	}
+	if opts.du && opts.sort == "" {
+		opts.sort = "size"
+	}
+	return opts, nil
+}
 
-	// 1) Gather pass
-	gather(dir, "")
-
-	// 2) Determine maximum length
-	maxLen := 0
-	for _, e := range all {
-		if e.runeLength > maxLen {
-			maxLen = e.runeLength
+// run prints the tree in three steps: gather reads the directory tree into
+// nodes, flatten lays them out as rows, and printLines aligns and prints
+// them. The other formats are written from the gathered nodes directly.
+func run(args []string, stdout io.Writer) error {
+	for _, a := range args {
+		switch a {
+		case "-?", "-h", "--help":
+			printUsage(stdout)
+			return nil
+		case "-v", "--version":
+			fmt.Fprintf(stdout, "%s v%s\n", programName, programVersion)
+			return nil
 		}
 	}
-
-	// 3) Print pass
-	for _, e := range all {
-		mark := "├── "
-		if e.isLast {
-			mark = "└── "
+	opts, err := parseArgs(args)
+	if err != nil {
+		return err
+	}
+	if opts.git || opts.hideIgnored {
+		if opts.status, err = loadGitStatus(opts.dir); err != nil {
+			return err
 		}
-		coloredName := color.Grn5(e.name)
-		if e.isDir {
-			coloredName = color.Blu5(e.name)
+	}
+	p := &printer{w: stdout, opts: opts}
+	if opts.stream {
+		root, err := rootNode(opts.dir)
+		if err != nil {
+			return err
 		}
+		nodes, _, err := listDir(opts.dir, opts)
+		if err != nil && nodes == nil {
+			return err
+		}
+		p.stream(nodes, "", 1, []fs.FileInfo{root.info})
+		p.summary()
+		if err != nil {
+			p.unreadable++
+		}
+		return unreadableError(p.unreadable)
+	}
 
-		line := e.prefix + mark + coloredName
-		spacing := max((maxLen+4)-e.runeLength, 1)
-
-		if e.isDir {
-			fmt.Println(line)
-		} else {
-			if showFullPath {
-				fmt.Printf("%s%s%s\n", line, strings.Repeat(" ", spacing), color.Cya5(e.fullPath))
-			} else {
-				fmt.Println(line)
-			}
+	root, err := gather(opts.dir, opts)
+	if err != nil {
+		return err
+	}
+	if opts.interact {
+		return navigate(stdout, root, opts)
+	}
+	if opts.format != "text" {
+		if err := writeFormat(stdout, root, opts.format); err != nil {
+			return err
 		}
+		return unreadableError(unreadable(root))
 	}
+	p.printLines(flatten(root.children, "", nil))
+	p.summary()
+	return unreadableError(unreadable(root))
+}
+
+// unreadableError reports count directories that could not be read.
+func unreadableError(count int) error {
+	if count == 0 {
+		return nil
+	}
+	return fmt.Errorf("%s could not be read", plural(count, "directory", "directories"))
 }
 
 func main() {
-	showFullPath := false
-	var dir string = "."
-	args := os.Args[1:]
-	if len(args) > 0 {
-		// Process command-line arguments in a loop to handle options and directory input.
-		// This approach allows for flexible argument ordering, enabling options to be specified
-		// before or after the directory. The loop iterates through each argument, setting flags
-		// or updating the directory variable as appropriate, ensuring that the last specified
-		// directory is used if multiple are provided.
-		for _, arg := range args {
-			if arg == "-?" || arg == "--help" || arg == "-h" {
-				printUsage()
-			} else if arg == "-v" || arg == "--version" {
-				fmt.Printf("%s v%s\n", programName, programVersion)
-				return
-			} else if arg == "-f" {
-				showFullPath = true
-			} else {
-				dir = arg
-			}
-		}
+	if err := run(os.Args[1:], os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", programName, err)
+		os.Exit(1)
 	}
-	printTree(dir, showFullPath)
 }
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/queone/utils/internal/bytesize"
+	"gopkg.in/yaml.v3"
+)
+
+func writeTree(t *testing.T, root string, files map[string]string) {
+	t.Helper()
+	for rel, content := range files {
+		p := filepath.Join(root, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// runTree returns the output of tree with args, without the summary line
+// that ends the text format.
+func runTree(t *testing.T, args ...string) string {
+	t.Helper()
+	var out strings.Builder
+	if err := run(args, &out); err != nil {
+		t.Fatalf("run(%q): %v", args, err)
+	}
+	rows, _, _ := strings.Cut(out.String(), "\n\n")
+	if rows != out.String() {
+		rows += "\n"
+	}
+	return rows
+}
+
+func TestTreeFilters(t *testing.T) {
+	root := t.TempDir()
+	writeTree(t, root, map[string]string{
+		".hidden/x.go":   "",
+		"b.txt":          "",
+		"cmd/main.go":    "",
+		"cmd/util/u.go":  "",
+		"docs/guide.md":  "",
+		"vendor/v.go":    "",
+		"go.mod":         "",
+		".env":           "",
+		"cmd/README.txt": "",
+	})
+
+	cases := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{
+			name: "default hides dot entries",
+			args: nil,
+			want: "├── b.txt\n├── cmd\n│   ├── README.txt\n│   ├── main.go\n│   └── util\n│       └── u.go\n├── docs\n│   └── guide.md\n├── go.mod\n└── vendor\n    └── v.go\n",
+		},
+		{
+			name: "all",
+			args: []string{"-a", "-L", "1"},
+			want: "├── .env\n├── .hidden\n├── b.txt\n├── cmd\n├── docs\n├── go.mod\n└── vendor\n",
+		},
+		{
+			name: "directories only",
+			args: []string{"-d"},
+			want: "├── cmd\n│   └── util\n├── docs\n└── vendor\n",
+		},
+		{
+			name: "include keeps ancestors",
+			args: []string{"-P", "*.go|*.mod", "-I", "vendor"},
+			want: "├── cmd\n│   ├── main.go\n│   └── util\n│       └── u.go\n└── go.mod\n",
+		},
+		{
+			name: "sort ext with directories first",
+			args: []string{"--sort=ext", "-L=1"},
+			want: "├── cmd\n├── docs\n├── vendor\n├── go.mod\n└── b.txt\n",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := runTree(t, append(tc.args, root)...); got != tc.want {
+				t.Fatalf("tree %q =\n%s\nwant\n%s", tc.args, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestSortNodesBySizeAndMtime(t *testing.T) {
+	root := t.TempDir()
+	writeTree(t, root, map[string]string{"small": "x", "big": "xxxx", "mid": "xx"})
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(filepath.Join(root, "big"), old, old); err != nil {
+		t.Fatal(err)
+	}
+	names := func(root *node, err error) string {
+		if err != nil {
+			t.Fatal(err)
+		}
+		var s []string
+		for _, n := range root.children {
+			s = append(s, n.name)
+		}
+		return strings.Join(s, " ")
+	}
+	if got := names(gather(root, options{sort: "size"})); got != "big mid small" {
+		t.Fatalf("size order = %s", got)
+	}
+	if got := names(gather(root, options{sort: "mtime"})); !strings.HasSuffix(got, "big") {
+		t.Fatalf("mtime order = %s", got)
+	}
+}
+
+func TestParseArgs(t *testing.T) {
+	for _, args := range [][]string{
+		{"-L"},
+		{"-L", "0"},
+		{"--sort", "color"},
+		{"-P", "[a"},
+		{"-o", "xml"},
+		{"--bogus"},
+	} {
+		if _, err := parseArgs(args); err == nil {
+			t.Errorf("parseArgs(%q) succeeded, want error", args)
+		}
+	}
+}
+
+func TestDiskUsage(t *testing.T) {
+	root := t.TempDir()
+	writeTree(t, root, map[string]string{
+		"small/a":         strings.Repeat("x", 10),
+		"big/b":           strings.Repeat("x", 100),
+		"big/deep/c":      strings.Repeat("x", 1000),
+		"big/.hidden/d":   strings.Repeat("x", 5),
+		"big/skipped.log": strings.Repeat("x", 2000),
+		"file":            strings.Repeat("x", 50),
+	})
+	top, err := gather(root, options{du: true, sort: "size", level: 1, exclude: []string{"*.log"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, n := range top.children {
+		got = append(got, n.name+"="+bytesize.Format(n.size))
+	}
+	// Totals include hidden, excluded and too-deep entries; files and
+	// directories sort together by size.
+	if want := "big=3.0K file=50B small=10B"; strings.Join(got, " ") != want {
+		t.Fatalf("du = %v, want %s", got, want)
+	}
+}
+
+func TestColumnsAlign(t *testing.T) {
+	root := t.TempDir()
+	writeTree(t, root, map[string]string{"a": "x", "longer-name": strings.Repeat("x", 2048)})
+	want := "├── a                1B\n└── longer-name    2.0K\n"
+	if got := runTree(t, "-s", root); got != want {
+		t.Fatalf("tree -s =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestOutputFormats(t *testing.T) {
+	root := t.TempDir()
+	writeTree(t, root, map[string]string{"pkg/a_b.go": "abc", "README.md": ""})
+
+	var got outNode
+	if err := json.Unmarshal([]byte(runTree(t, "-o", "json", root)), &got); err != nil {
+		t.Fatalf("json output: %v", err)
+	}
+	want := outNode{Name: root, Path: root, Type: "directory", Size: got.Size, Children: []*outNode{
+		{Name: "README.md", Path: filepath.Join(root, "README.md"), Type: "file"},
+		{Name: "pkg", Path: filepath.Join(root, "pkg"), Type: "directory", Size: got.Children[1].Size, Children: []*outNode{
+			{Name: "a_b.go", Path: filepath.Join(root, "pkg", "a_b.go"), Type: "file", Size: 3},
+		}},
+	}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("json = %+v, want %+v", got, want)
+	}
+
+	var fromYAML outNode
+	if err := yaml.Unmarshal([]byte(runTree(t, "-o", "yaml", root)), &fromYAML); err != nil || !reflect.DeepEqual(fromYAML, want) {
+		t.Fatalf("yaml = %+v, %v; want %+v", fromYAML, err, want)
+	}
+
+	md := runTree(t, "-o", "md", root)
+	if !strings.HasSuffix(md, "  - README.md\n  - **pkg/**\n    - a\\_b.go\n") {
+		t.Fatalf("md =\n%s", md)
+	}
+
+	page := runTree(t, "-o", "html", root)
+	if !strings.Contains(page, "<details open><summary") || !strings.HasSuffix(page, "</html>\n") {
+		t.Fatalf("html =\n%s", page)
+	}
+}
+
+func TestGitStatus(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	root := t.TempDir()
+	git := func(args ...string) {
+		t.Helper()
+		cmd := exec.Command("git", append([]string{"-C", root, "-c", "user.name=t", "-c", "user.email=t@t"}, args...)...)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %q: %v\n%s", args, err, out)
+		}
+	}
+	writeTree(t, root, map[string]string{".gitignore": "build/\n", "sub/a": "1", "clean/b": "1"})
+	git("init", "-q")
+	git("add", "-A")
+	git("commit", "-qm", "init")
+	writeTree(t, root, map[string]string{"sub/a": "2", "sub/new": "", "build/out": ""})
+
+	want := "├── build      !!\n│   └── out    !!\n├── clean\n│   └── b\n└── sub         *\n    ├── a       M\n    └── new    ??\n"
+	if got := runTree(t, "--git", root); got != want {
+		t.Fatalf("tree --git =\n%q\nwant\n%q", got, want)
+	}
+	if got := runTree(t, "--hide-ignored", root); strings.Contains(got, "build") {
+		t.Fatalf("tree --hide-ignored =\n%s", got)
+	}
+
+	var out strings.Builder
+	if err := run([]string{"--git", t.TempDir()}, &out); err == nil {
+		t.Fatal("tree --git outside a work tree succeeded")
+	}
+}
+
+func TestStreamMatchesGatheredOutput(t *testing.T) {
+	root := t.TempDir()
+	writeTree(t, root, map[string]string{"a/b/c.txt": "", "a/d.txt": "", "e.txt": "", "f/g.go": ""})
+	for _, args := range [][]string{{"--sort", "name"}, {"--sort", "name", "-L", "2"}, {"--sort", "name", "-d"}} {
+		var whole, streamed strings.Builder
+		if err := run(append(args, root), &whole); err != nil {
+			t.Fatal(err)
+		}
+		if err := run(append(args, "--stream", root), &streamed); err != nil {
+			t.Fatal(err)
+		}
+		if whole.String() != streamed.String() {
+			t.Fatalf("tree %q --stream =\n%s\nwant\n%s", args, streamed.String(), whole.String())
+		}
+	}
+
+	var out strings.Builder
+	if err := run([]string{root}, &out); err != nil || !strings.HasSuffix(out.String(), "\n3 directories, 4 files\n") {
+		t.Fatalf("summary = %q, %v", out.String(), err)
+	}
+}
+
+func TestUnreadableDirectoryIsReported(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("root can read any directory")
+	}
+	root := t.TempDir()
+	writeTree(t, root, map[string]string{"locked/x": "", "open/y": ""})
+	locked := filepath.Join(root, "locked")
+	if err := os.Chmod(locked, 0); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chmod(locked, 0755) })
+
+	for _, args := range [][]string{{root}, {"--stream", root}} {
+		var out strings.Builder
+		err := run(args, &out)
+		if err == nil || !strings.Contains(out.String(), "locked    [cannot read: permission denied]") {
+			t.Fatalf("tree %q = %v\n%s", args, err, out.String())
+		}
+	}
+}
+
+func TestSymlinks(t *testing.T) {
+	root := t.TempDir()
+	writeTree(t, root, map[string]string{"real/f.txt": ""})
+	for link, target := range map[string]string{
+		"real/up":  "..",
+		"to-real":  "real",
+		"dangling": "missing",
+	} {
+		if err := os.Symlink(target, filepath.Join(root, link)); err != nil {
+			t.Skipf("symlinks unavailable: %v", err)
+		}
+	}
+
+	want := "├── dangling -> missing    [broken link]\n├── real\n│   ├── f.txt\n│   └── up -> ..\n└── to-real -> real\n"
+	if got := runTree(t, root); got != want {
+		t.Fatalf("tree =\n%s\nwant\n%s", got, want)
+	}
+
+	// With -l, to-real is listed but real/up, which leads back to the
+	// root, is not followed, here or below to-real.
+	want = "├── dangling -> missing    [broken link]\n" +
+		"├── real\n│   ├── f.txt\n│   └── up -> ..           [recursive, not followed]\n" +
+		"└── to-real -> real\n    ├── f.txt\n    └── up -> ..           [recursive, not followed]\n"
+	if got := runTree(t, "-l", root); got != want {
+		t.Fatalf("tree -l =\n%s\nwant\n%s", got, want)
+	}
+	// --stream aligns columns per directory only.
+	if got := runTree(t, "-l", "--stream", root); strings.Join(strings.Fields(got), " ") != strings.Join(strings.Fields(want), " ") {
+		t.Fatalf("tree -l --stream =\n%s\nwant\n%s", got, want)
+	}
+
+	var got outNode
+	if err := json.Unmarshal([]byte(runTree(t, "-o", "json", root)), &got); err != nil {
+		t.Fatal(err)
+	}
+	if c := got.Children[0]; c.Type != "symlink" || c.Target != "missing" || !c.Broken {
+		t.Fatalf("json dangling = %+v", c)
+	}
+}
+
+func TestNavigatorPreview(t *testing.T) {
+	root := t.TempDir()
+	writeTree(t, root, map[string]string{"src/a.go": "line 1\nline 2\nline 3\n", "src/lib/b.go": "", "bin.dat": "\x00\x01"})
+	top, err := gather(root, options{sort: "name"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var items []string
+	byName := map[string]*node{}
+	for _, l := range flatten(top.children, "", nil) {
+		items = append(items, itemText(root, l.node))
+		byName[l.node.name] = l.node
+	}
+	sep := string(filepath.Separator)
+	want := []string{"src" + sep, filepath.Join("src", "lib") + sep, filepath.Join("src", "lib", "b.go"), filepath.Join("src", "a.go"), "bin.dat"}
+	if !reflect.DeepEqual(items, want) {
+		t.Fatalf("items = %q, want %q", items, want)
+	}
+
+	opts := options{sort: "name"}
+	if got := preview(byName["a.go"], opts, 2); got != "line 1\nline 2\n" {
+		t.Fatalf("file preview = %q", got)
+	}
+	if got := preview(byName["src"], opts, 10); got != "├── lib\n│   └── b.go\n└── a.go\n" {
+		t.Fatalf("directory preview = %q", got)
+	}
+	if got := preview(byName["bin.dat"], opts, 10); got != "binary file, 2B" {
+		t.Fatalf("binary preview = %q", got)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"strings"
+
+	"github.com/queone/utils/internal/bytesize"
+	"gopkg.in/yaml.v3"
+)
+
+// formats are the accepted -o values; "text" is the box-drawing tree.
+var formats = []string{"text", "json", "yaml", "md", "html"}
+
+// outNode is the structured form of a node for the json and yaml formats.
+type outNode struct {
+	Name     string     `json:"name" yaml:"name"`
+	Path     string     `json:"path" yaml:"path"`
+	Type     string     `json:"type" yaml:"type"`
+	Size     int64      `json:"size" yaml:"size"`
+	Git      string     `json:"git,omitempty" yaml:"git,omitempty"`
+	Target   string     `json:"target,omitempty" yaml:"target,omitempty"` // of a symlink
+	Broken   bool       `json:"broken,omitempty" yaml:"broken,omitempty"`
+	Children []*outNode `json:"children,omitempty" yaml:"children,omitempty"`
+}
+
+func nodeType(n *node) string {
+	switch {
+	case n.link != "":
+		return "symlink"
+	case n.isDir():
+		return "directory"
+	}
+	return "file"
+}
+
+func toOutNode(n *node) *outNode {
+	o := &outNode{Name: n.name, Path: n.path, Type: nodeType(n), Size: n.size, Git: n.git,
+		Target: n.link, Broken: n.broken}
+	for _, c := range n.children {
+		o.Children = append(o.Children, toOutNode(c))
+	}
+	return o
+}
+
+// writeFormat writes the tree under root to w in format, one of formats
+// other than "text".
+func writeFormat(w io.Writer, root *node, format string) error {
+	switch format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetEscapeHTML(false)
+		enc.SetIndent("", "  ")
+		return enc.Encode(toOutNode(root))
+	case "yaml":
+		enc := yaml.NewEncoder(w)
+		enc.SetIndent(2)
+		if err := enc.Encode(toOutNode(root)); err != nil {
+			return err
+		}
+		return enc.Close()
+	case "md":
+		writeMarkdown(w, root, 0)
+	case "html":
+		writeHTML(w, root)
+	}
+	return nil
+}
+
+// mdEscaper escapes the characters that would turn a name into Markdown
+// emphasis, links or code.
+var mdEscaper = strings.NewReplacer(`\`, `\\`, "`", "\\`", "*", `\*`, "_", `\_`, "[", `\[`, "]", `\]`)
+
+// writeMarkdown writes n as a nested list, directories in bold with a
+// trailing slash.
+func writeMarkdown(w io.Writer, n *node, depth int) {
+	name := mdEscaper.Replace(n.label())
+	if n.isDir() {
+		name = "**" + name + "/**"
+	}
+	fmt.Fprintf(w, "%s- %s\n", strings.Repeat("  ", depth), name)
+	for _, c := range n.children {
+		writeMarkdown(w, c, depth+1)
+	}
+}
+
+const htmlHead = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>%s</title>
+<style>
+body { font-family: ui-monospace, SFMono-Regular, Menlo, monospace; font-size: 14px; }
+ul { list-style: none; margin: 0; padding-left: 1.4em; }
+summary { cursor: pointer; color: #1f5fbf; }
+.size { color: #888; margin-left: 1em; }
+</style>
+</head>
+<body>
+`
+
+// writeHTML writes a standalone page in which every directory is a
+// collapsible <details> element, open by default.
+func writeHTML(w io.Writer, root *node) {
+	fmt.Fprintf(w, htmlHead, html.EscapeString(root.path))
+	fmt.Fprintln(w, "<ul>")
+	writeHTMLNode(w, root)
+	fmt.Fprintln(w, "</ul>\n</body>\n</html>")
+}
+
+func writeHTMLNode(w io.Writer, n *node) {
+	name := html.EscapeString(n.label())
+	size := fmt.Sprintf(`<span class="size">%s</span>`, bytesize.Format(n.size))
+	if !n.isDir() {
+		fmt.Fprintf(w, "<li title=\"%s\">%s%s</li>\n", html.EscapeString(n.path), name, size)
+		return
+	}
+	fmt.Fprintf(w, "<li><details open><summary title=\"%s\">%s/%s</summary>\n<ul>\n", html.EscapeString(n.path), name, size)
+	for _, c := range n.children {
+		writeHTMLNode(w, c)
+	}
+	fmt.Fprintln(w, "</ul></details></li>")
+}
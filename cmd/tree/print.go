@@ -0,0 +1,213 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/queone/governa-color"
+	"github.com/queone/utils/internal/bytesize"
+)
+
+// line is one row of the printed tree.
+type line struct {
+	prefix string // box-drawing prefix inherited from the ancestors
+	isLast bool   // the last entry of its directory
+	node   *node
+}
+
+// mark returns the branch drawn in front of the entry.
+func (l line) mark() string {
+	if l.isLast {
+		return "└── "
+	}
+	return "├── "
+}
+
+// label returns the name of n as printed, with a symlink's target.
+func (n *node) label() string {
+	if n.link != "" {
+		return n.name + " -> " + n.link
+	}
+	return n.name
+}
+
+// runeLength is the printed width of the line without colors.
+func (l line) runeLength() int {
+	return utf8.RuneCountInString(l.prefix + l.mark() + l.node.label())
+}
+
+// flatten turns the gathered tree into its printed rows, in order.
+func flatten(nodes []*node, prefix string, out []line) []line {
+	for i, n := range nodes {
+		isLast := i == len(nodes)-1
+		out = append(out, line{prefix: prefix, isLast: isLast, node: n})
+		if n.isDir() {
+			out = flatten(n.children, out[len(out)-1].childPrefix(), out)
+		}
+	}
+	return out
+}
+
+// columns returns the --git, -p, -s and -D columns of n that opts asks for.
+func columns(n *node, opts options) []string {
+	var cols []string
+	if opts.git {
+		cols = append(cols, n.git)
+	}
+	if opts.perms {
+		cols = append(cols, n.info.Mode().String())
+	}
+	if opts.size {
+		cols = append(cols, bytesize.Format(n.size))
+	}
+	if opts.mtime {
+		cols = append(cols, n.info.ModTime().Format("2006-01-02 15:04"))
+	}
+	return cols
+}
+
+// childPrefix returns the prefix of the rows below the entry of l.
+func (l line) childPrefix() string {
+	if l.isLast {
+		return l.prefix + "    "
+	}
+	return l.prefix + "│   "
+}
+
+// readError describes why n could not be read.
+func readError(n *node) string {
+	var pe *fs.PathError
+	if errors.As(n.err, &pe) {
+		return pe.Err.Error()
+	}
+	return n.err.Error()
+}
+
+// printer writes the rows of the text format and counts what it printed
+// for the summary line.
+type printer struct {
+	w          io.Writer
+	opts       options
+	dirs       int
+	files      int
+	unreadable int
+}
+
+// printLines writes the rows to w. The columns, and with opts.fullPath
+// each file's path, are printed aligned past the longest row.
+func (p *printer) printLines(lines []line) {
+	maxLen, cols, widths := p.measure(lines)
+	for i, l := range lines {
+		p.row(l, maxLen, cols[i], widths)
+	}
+}
+
+// measure returns the width of the longest of lines, and their columns
+// with the width of each column.
+func (p *printer) measure(lines []line) (maxLen int, cols [][]string, widths []int) {
+	cols = make([][]string, len(lines))
+	for i, l := range lines {
+		maxLen = max(maxLen, l.runeLength())
+		cols[i] = columns(l.node, p.opts)
+		for c, v := range cols[i] {
+			if c == len(widths) {
+				widths = append(widths, 0)
+			}
+			widths[c] = max(widths[c], utf8.RuneCountInString(v))
+		}
+	}
+	return maxLen, cols, widths
+}
+
+// row writes one row with its columns padded to widths, starting past
+// maxLen.
+func (p *printer) row(l line, maxLen int, cols []string, widths []int) {
+	n := l.node
+	name := color.Grn5(n.name)
+	if n.isDir() {
+		name = color.Blu5(n.name)
+		p.dirs++
+	} else {
+		p.files++
+	}
+	switch {
+	case n.broken:
+		name = color.Red5(n.name) + " -> " + color.Red5(n.link)
+	case n.link != "":
+		name = color.Cya5(n.name) + " -> " + n.link
+	}
+	var tail []string
+	for c, v := range cols {
+		tail = append(tail, fmt.Sprintf("%*s", widths[c], v))
+	}
+	if p.opts.fullPath && !n.isDir() {
+		tail = append(tail, color.Cya5(n.path))
+	}
+	if n.broken {
+		tail = append(tail, color.Red5("[broken link]"))
+	}
+	if n.loop {
+		tail = append(tail, color.Yel5("[recursive, not followed]"))
+	}
+	if n.err != nil {
+		p.unreadable++
+		tail = append(tail, color.Red5("[cannot read: "+readError(n)+"]"))
+	}
+	row := l.prefix + l.mark() + name
+	rest := strings.TrimRight(strings.Join(tail, "  "), " ")
+	if rest == "" {
+		fmt.Fprintln(p.w, row)
+		return
+	}
+	spacing := max((maxLen+4)-l.runeLength(), 1)
+	fmt.Fprintf(p.w, "%s%s%s\n", row, strings.Repeat(" ", spacing), rest)
+}
+
+// stream lists the tree under nodes, the entries of a directory at depth
+// below ancestors, while reading it: each directory is read just before its row is printed,
+// and columns are only aligned among the entries of one directory.
+func (p *printer) stream(nodes []*node, prefix string, depth int, ancestors []fs.FileInfo) {
+	sortNodes(nodes, p.opts.sort, true)
+	lines := make([]line, len(nodes))
+	for i, n := range nodes {
+		lines[i] = line{prefix: prefix, isLast: i == len(nodes)-1, node: n}
+	}
+	maxLen, cols, widths := p.measure(lines)
+	for i, l := range lines {
+		n := l.node
+		var below []fs.FileInfo
+		descend := n.isDir() && (p.opts.level == 0 || depth < p.opts.level)
+		if descend {
+			if below, descend = n.enter(ancestors, p.opts); descend {
+				n.children, _, n.err = listDir(n.path, p.opts)
+			}
+		}
+		p.row(l, maxLen, cols[i], widths)
+		if descend {
+			p.stream(n.children, l.childPrefix(), depth+1, below)
+			n.children = nil
+		}
+	}
+}
+
+// plural returns "1 file" or "3 files" style counts.
+func plural(n int, one, many string) string {
+	if n == 1 {
+		return "1 " + one
+	}
+	return fmt.Sprintf("%d %s", n, many)
+}
+
+// summary writes the closing count line.
+func (p *printer) summary() {
+	dirs := plural(p.dirs, "directory", "directories")
+	if p.opts.dirsOnly {
+		fmt.Fprintf(p.w, "\n%s\n", dirs)
+		return
+	}
+	fmt.Fprintf(p.w, "\n%s, %s\n", dirs, plural(p.files, "file", "files"))
+}
@@ -0,0 +1,19 @@
+// Package bytesize formats byte counts for display. It backs the size
+// columns and summaries printed by bak and tree.
+package bytesize
+
+import "fmt"
+
+// Format formats n bytes with a binary unit suffix, e.g. 4.2K or 17M.
+func Format(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%c", float64(n)/float64(div), "KMGTPE"[exp])
+}
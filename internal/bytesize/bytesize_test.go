@@ -0,0 +1,12 @@
+package bytesize
+
+import "testing"
+
+func TestFormat(t *testing.T) {
+	cases := map[int64]string{0: "0B", 1023: "1023B", 1024: "1.0K", 1536: "1.5K", 5 << 20: "5.0M", 3 << 30: "3.0G"}
+	for n, want := range cases {
+		if got := Format(n); got != want {
+			t.Errorf("Format(%d) = %q, want %q", n, got, want)
+		}
+	}
+}
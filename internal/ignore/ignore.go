@@ -0,0 +1,232 @@
+// Package ignore matches slash-separated relative paths against
+// gitignore-style rules: blank lines and # comments are skipped, a leading !
+// re-includes, a trailing / limits a rule to directories, a rule containing
+// a / is anchored to the directory of the file that holds it, and ** spans
+// any number of directories. It backs bak's .bakignore and fr's
+// .gitignore/.ignore handling.
+package ignore
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// rule is one compiled pattern line.
+type rule struct {
+	base    string // directory the rule is relative to; "" for the root
+	negate  bool   // line started with !
+	dirOnly bool   // line ended with /
+	re      *regexp.Regexp
+}
+
+// Matcher holds rules in the order they were added. When several rules
+// match a path, the last one wins, so rules from deeper ignore files should
+// be added after those of their parents.
+type Matcher struct {
+	rules []rule
+}
+
+// New returns an empty Matcher.
+func New() *Matcher {
+	return &Matcher{}
+}
+
+// Len returns the number of rules in the Matcher.
+func (m *Matcher) Len() int {
+	return len(m.rules)
+}
+
+// Add compiles gitignore-syntax lines relative to base, a slash-separated
+// directory ("" for the root), and appends them to the Matcher.
+func (m *Matcher) Add(base string, lines []string) error {
+	base = strings.Trim(base, "/")
+	if base == "." {
+		base = ""
+	}
+	for i, line := range lines {
+		r, ok, err := parseLine(line)
+		if err != nil {
+			return fmt.Errorf("line %d: %w", i+1, err)
+		}
+		if ok {
+			r.base = base
+			m.rules = append(m.rules, r)
+		}
+	}
+	return nil
+}
+
+// AddFile reads a gitignore-syntax file and appends its rules relative to
+// base. A missing file adds nothing and is not an error.
+func (m *Matcher) AddFile(base, path string) error {
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var lines []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		lines = append(lines, sc.Text())
+	}
+	if err := sc.Err(); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	if err := m.Add(base, lines); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+// Match reports whether the rules exclude path itself. Callers walking a
+// tree should skip matched directories, since nothing below an excluded
+// directory can be re-included.
+func (m *Matcher) Match(path string, isDir bool) bool {
+	path = strings.Trim(path, "/")
+	for i := len(m.rules) - 1; i >= 0; i-- {
+		r := m.rules[i]
+		if r.dirOnly && !isDir {
+			continue
+		}
+		rel := path
+		if r.base != "" {
+			var ok bool
+			if rel, ok = strings.CutPrefix(path, r.base+"/"); !ok {
+				continue
+			}
+		}
+		if r.re.MatchString(rel) {
+			return !r.negate
+		}
+	}
+	return false
+}
+
+// MatchParents reports whether path or any directory above it is excluded,
+// for callers that check individual paths instead of walking.
+func (m *Matcher) MatchParents(path string, isDir bool) bool {
+	path = strings.Trim(path, "/")
+	for i := 0; i < len(path); i++ {
+		if path[i] == '/' && m.Match(path[:i], true) {
+			return true
+		}
+	}
+	return m.Match(path, isDir)
+}
+
+// parseLine compiles one gitignore line. It reports false for blank lines
+// and comments.
+func parseLine(line string) (rule, bool, error) {
+	var r rule
+	line = strings.TrimSuffix(line, "\r")
+	for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, `\ `) {
+		line = line[:len(line)-1]
+	}
+	if line == "" || strings.HasPrefix(line, "#") {
+		return r, false, nil
+	}
+	if strings.HasPrefix(line, "!") {
+		r.negate = true
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		r.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if line == "" {
+		return r, false, nil
+	}
+
+	anchored := strings.Contains(line, "/")
+	line = strings.TrimPrefix(line, "/")
+	expr := "^" + globToRegexp(line) + "$"
+	if !anchored {
+		expr = "^(?:.*/)?" + globToRegexp(line) + "$"
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return r, false, fmt.Errorf("invalid pattern %q: %w", line, err)
+	}
+	r.re = re
+	return r, true, nil
+}
+
+// globToRegexp translates a gitignore glob into an unanchored regular
+// expression. * and ? never cross a /, while a ** path segment matches any
+// number of directories.
+func globToRegexp(glob string) string {
+	var b strings.Builder
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch c {
+		case '*':
+			if i+1 < len(glob) && glob[i+1] == '*' {
+				segStart := i == 0 || glob[i-1] == '/'
+				next := i + 2
+				switch {
+				case segStart && next < len(glob) && glob[next] == '/':
+					b.WriteString("(?:.*/)?")
+					i = next
+				case segStart && next == len(glob):
+					b.WriteString(".*")
+					i = next - 1
+				default:
+					b.WriteString("[^/]*")
+					i++
+				}
+				continue
+			}
+			b.WriteString("[^/]*")
+		case '?':
+			b.WriteString("[^/]")
+		case '[':
+			end := classEnd(glob, i)
+			if end < 0 {
+				b.WriteString(`\[`)
+				continue
+			}
+			class := glob[i+1 : end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+			i = end
+		case '\\':
+			if i+1 < len(glob) {
+				i++
+				c = glob[i]
+			}
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return b.String()
+}
+
+// classEnd returns the index of the ] closing the bracket expression that
+// starts at glob[start], or -1 when it is unterminated.
+func classEnd(glob string, start int) int {
+	i := start + 1
+	if i < len(glob) && (glob[i] == '!' || glob[i] == '^') {
+		i++
+	}
+	if i < len(glob) && glob[i] == ']' {
+		i++
+	}
+	for ; i < len(glob); i++ {
+		if glob[i] == ']' {
+			return i
+		}
+	}
+	return -1
+}
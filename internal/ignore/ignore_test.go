@@ -0,0 +1,112 @@
+package ignore
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMatch(t *testing.T) {
+	cases := []struct {
+		name  string
+		lines []string
+		path  string
+		isDir bool
+		want  bool
+	}{
+		{"basename anywhere", []string{"*.log"}, "a/b/x.log", false, true},
+		{"star stays in segment", []string{"a/*.log"}, "a/b/x.log", false, false},
+		{"anchored leading slash", []string{"/build"}, "build", true, true},
+		{"anchored not nested", []string{"/build"}, "src/build", true, false},
+		{"dir only skips files", []string{"cache/"}, "cache", false, false},
+		{"dir only matches dirs", []string{"cache/"}, "x/cache", true, true},
+		{"leading double star", []string{"**/objects"}, ".git/objects", true, true},
+		{"leading double star at root", []string{"**/objects"}, "objects", true, true},
+		{"middle double star", []string{"a/**/z"}, "a/b/c/z", false, true},
+		{"middle double star zero dirs", []string{"a/**/z"}, "a/z", false, true},
+		{"trailing double star", []string{"out/**"}, "out/x/y", false, true},
+		{"trailing double star not dir itself", []string{"out/**"}, "out", true, false},
+		{"negation re-includes", []string{"*.log", "!keep.log"}, "keep.log", false, false},
+		{"later rule wins", []string{"!keep.log", "*.log"}, "keep.log", false, true},
+		{"question mark", []string{"file?.txt"}, "file1.txt", false, true},
+		{"char class", []string{"file[0-9].txt"}, "file7.txt", false, true},
+		{"negated char class", []string{"file[!0-9].txt"}, "file7.txt", false, false},
+		{"escaped bang", []string{`\!important`}, "!important", false, true},
+		{"escaped hash", []string{`\#notes`}, "#notes", false, true},
+		{"comment ignored", []string{"# *.go"}, "main.go", false, false},
+		{"trailing spaces trimmed", []string{"tmp   "}, "tmp", false, true},
+		{"dots are literal", []string{"a.b"}, "axb", false, false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			m := New()
+			if err := m.Add("", tc.lines); err != nil {
+				t.Fatalf("Add: %v", err)
+			}
+			if got := m.Match(tc.path, tc.isDir); got != tc.want {
+				t.Fatalf("Match(%q, %v) with %q = %v, want %v", tc.path, tc.isDir, tc.lines, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestMatchBase(t *testing.T) {
+	m := New()
+	if err := m.Add("", []string{"*.tmp"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Add("sub", []string{"/gen", "!keep.tmp"}); err != nil {
+		t.Fatal(err)
+	}
+	cases := map[string]bool{
+		"gen":          false,
+		"sub/gen":      true,
+		"sub/x/gen":    false,
+		"a.tmp":        true,
+		"sub/keep.tmp": false,
+		"keep.tmp":     true,
+		"subway/gen":   false,
+	}
+	for path, want := range cases {
+		if got := m.Match(path, false); got != want {
+			t.Errorf("Match(%q) = %v, want %v", path, got, want)
+		}
+	}
+}
+
+func TestMatchParents(t *testing.T) {
+	m := New()
+	if err := m.Add("", []string{"node_modules/"}); err != nil {
+		t.Fatal(err)
+	}
+	if m.Match("web/node_modules/x/index.js", false) {
+		t.Fatal("Match matched a path below an excluded directory")
+	}
+	if !m.MatchParents("web/node_modules/x/index.js", false) {
+		t.Fatal("MatchParents missed a path below an excluded directory")
+	}
+	if m.MatchParents("web/src/index.js", false) {
+		t.Fatal("MatchParents matched an unrelated path")
+	}
+}
+
+func TestAddFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, ".gitignore")
+	if err := os.WriteFile(path, []byte("# build output\r\nbin/\r\n\r\n*.o\r\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	m := New()
+	if err := m.AddFile("", path); err != nil {
+		t.Fatalf("AddFile: %v", err)
+	}
+	if m.Len() != 2 {
+		t.Fatalf("Len = %d, want 2", m.Len())
+	}
+	if !m.Match("bin", true) || !m.Match("x/y.o", false) {
+		t.Fatal("rules from file not applied")
+	}
+	if err := m.AddFile("", filepath.Join(dir, "missing")); err != nil {
+		t.Fatalf("AddFile missing: %v", err)
+	}
+}